@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/retrixe/imprint/imaging"
+	"github.com/retrixe/udf"
+)
+
+// fat32MaxFileSize is the largest file FAT32 can store, 4 GiB - 1 byte.
+const fat32MaxFileSize = 4*1024*1024*1024 - 1
+
+// windowsMaxPath is MAX_PATH, which includes the drive letter ("X:\") and terminating NUL.
+const windowsMaxPath = 260
+
+// ContentEntry is a file or folder which will be written to the USB drive.
+type ContentEntry struct {
+	Path  string // Slash-separated path relative to the root of the USB drive
+	IsDir bool
+	Size  int64
+}
+
+// ContentAnalysis describes everything which will be written to the USB drive, i.e. the contents
+// of the ISO excluding any excluded files, with the overlay applied on top.
+type ContentAnalysis struct {
+	Entries   []ContentEntry
+	TotalSize int64
+}
+
+// AnalyzeContents collects the files and folders which will be written to the USB drive.
+func AnalyzeContents(iso *udf.Udf, exclude ExcludePatterns, overlay Overlay) *ContentAnalysis {
+	analysis := &ContentAnalysis{}
+	var walk func(files []udf.File, relPath string)
+	walk = func(files []udf.File, relPath string) {
+		for _, file := range files {
+			filePath := path.Join(relPath, file.Name())
+			if exclude.Matches(filePath) {
+				continue
+			} else if file.IsDir() {
+				analysis.Entries = append(analysis.Entries, ContentEntry{Path: filePath, IsDir: true})
+				walk(file.ReadDir(), filePath)
+			} else if !overlay.Contains(filePath) {
+				analysis.Entries = append(analysis.Entries, ContentEntry{Path: filePath, Size: file.Size()})
+			}
+		}
+	}
+	walk(iso.ReadDir(nil), "")
+	for relPath, file := range overlay {
+		if file.IsDir && slices.ContainsFunc(analysis.Entries, func(e ContentEntry) bool { return e.Path == relPath }) {
+			continue // Folder already exists in the ISO
+		}
+		analysis.Entries = append(analysis.Entries, ContentEntry{Path: relPath, IsDir: file.IsDir, Size: file.Size})
+	}
+	slices.SortFunc(analysis.Entries, func(a, b ContentEntry) int { return strings.Compare(a.Path, b.Path) })
+	for _, entry := range analysis.Entries {
+		analysis.TotalSize += entry.Size
+	}
+	return analysis
+}
+
+// EstimateUsage estimates the space the contents will take up on a partition of the given size
+// formatted with the given filesystem, accounting for cluster slack and filesystem metadata.
+func (a *ContentAnalysis) EstimateUsage(filesystem string, partitionSize int64) int64 {
+	clusterSize := getDefaultClusterSize(filesystem, partitionSize)
+	clusters := partitionSize / clusterSize
+	var usage int64
+	switch filesystem {
+	case "fat32":
+		usage = 32*512 + 2*clusters*4 // Reserved sectors and two copies of the FAT
+	case "exfat":
+		usage = 1024*1024 + clusters*4 + clusters/8 // Boot region, FAT and allocation bitmap
+	case "ntfs":
+		usage = 64*1024*1024 + clusters/8 // $LogFile and other system files, and $Bitmap
+	}
+	for _, entry := range a.Entries {
+		if entry.IsDir && filesystem != "ntfs" {
+			usage += clusterSize // Every FAT/exFAT directory takes up at least one cluster
+		} else if entry.IsDir {
+			usage += 4096 // MFT record and index allocation
+		} else {
+			usage += (entry.Size + clusterSize - 1) / clusterSize * clusterSize
+			if filesystem == "ntfs" {
+				usage += 1024 // MFT record
+			}
+		}
+	}
+	return usage
+}
+
+// getDefaultClusterSize returns the cluster size mkfs tools default to for a partition size.
+func getDefaultClusterSize(filesystem string, partitionSize int64) int64 {
+	const gib = 1024 * 1024 * 1024
+	switch filesystem {
+	case "fat32":
+		switch {
+		case partitionSize <= 8*gib:
+			return 4096
+		case partitionSize <= 16*gib:
+			return 8192
+		case partitionSize <= 32*gib:
+			return 16384
+		default:
+			return 32768
+		}
+	case "exfat":
+		switch {
+		case partitionSize < 256*1024*1024:
+			return 4096
+		case partitionSize < 32*gib:
+			return 32768
+		default:
+			return 131072
+		}
+	default:
+		return 4096
+	}
+}
+
+// CheckCompatibility checks whether the contents can be written to a partition of the given size
+// formatted with the given filesystem, and can be used by Windows from there. A problem is returned
+// for each incompatibility found.
+func (a *ContentAnalysis) CheckCompatibility(filesystem string, partitionSize int64) []error {
+	problems := []error{}
+	if usage := a.EstimateUsage(filesystem, partitionSize); usage > partitionSize {
+		problems = append(problems, fmt.Errorf("files need about %s on %s, but the partition can only hold %s",
+			imaging.BytesToString(int(usage), true), getFilesystemName(filesystem),
+			imaging.BytesToString(int(partitionSize), true)))
+	}
+
+	namesByFolder := make(map[string]map[string]string)
+	for _, entry := range a.Entries {
+		name := path.Base(entry.Path)
+		if !entry.IsDir && filesystem == "fat32" && entry.Size > fat32MaxFileSize {
+			problems = append(problems, fmt.Errorf("%s is %s, exceeds FAT32's 4 GB file size limit",
+				entry.Path, imaging.BytesToString(int(entry.Size), false)))
+		}
+		if length := len(utf16.Encode([]rune(name))); length > 255 {
+			problems = append(problems, fmt.Errorf("%s has a name longer than 255 characters", entry.Path))
+		}
+		if len(utf16.Encode([]rune(entry.Path)))+len("X:\\")+1 > windowsMaxPath {
+			problems = append(problems, fmt.Errorf("%s has a path longer than Windows supports (%d characters)",
+				entry.Path, windowsMaxPath))
+		}
+		if invalid := strings.IndexFunc(name, isInvalidFilenameRune); invalid >= 0 {
+			problems = append(problems, fmt.Errorf("%s contains %q, which %s does not allow in file names",
+				entry.Path, []rune(name[invalid:])[0], getFilesystemName(filesystem)))
+		} else if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			problems = append(problems, fmt.Errorf("%s ends with a period or space, which Windows does not allow",
+				entry.Path))
+		}
+
+		// FAT32 and exFAT are case-insensitive, so names differing only by case would clash
+		if filesystem == "fat32" || filesystem == "exfat" {
+			folder := path.Dir(entry.Path)
+			if namesByFolder[folder] == nil {
+				namesByFolder[folder] = make(map[string]string)
+			}
+			if existing, ok := namesByFolder[folder][strings.ToLower(name)]; ok {
+				problems = append(problems, fmt.Errorf("%s and %s differ only by case, which %s does not allow",
+					path.Join(folder, existing), entry.Path, getFilesystemName(filesystem)))
+			} else {
+				namesByFolder[folder][strings.ToLower(name)] = name
+			}
+		}
+	}
+	return problems
+}
+
+// FormatCompatibilityProblems formats the problems found by CheckCompatibility as a bulleted list,
+// truncated to the first few problems.
+func FormatCompatibilityProblems(problems []error) string {
+	const maxProblems = 10
+	messages := []string{}
+	for index, problem := range problems {
+		if index == maxProblems {
+			messages = append(messages, fmt.Sprintf("...and %d more problems", len(problems)-maxProblems))
+			break
+		}
+		messages = append(messages, "- "+problem.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// isInvalidFilenameRune reports characters which FAT32, exFAT and NTFS (in the Win32 namespace
+// Windows uses) do not allow in file names.
+func isInvalidFilenameRune(r rune) bool {
+	return r < 0x20 || strings.ContainsRune("\"*/:<>?\\|", r)
+}
+
+func getFilesystemName(filesystem string) string {
+	switch filesystem {
+	case "fat32":
+		return "FAT32"
+	case "exfat":
+		return "exFAT"
+	case "ntfs":
+		return "NTFS"
+	}
+	return filesystem
+}
+
+// ChooseFilesystem picks the filesystem to format the drive with when none was specified, out of
+// the filesystems the system can create. FAT32 is preferred when every file fits on it, since a
+// single FAT32 partition boots on any UEFI PC (with or without Secure Boot) and on legacy BIOS PCs
+// when using MBR. Otherwise NTFS is used with UEFI:NTFS, falling back to exFAT without NTFS
+// drivers. A human-readable explanation of the choice is returned along with it.
+func (a *ContentAnalysis) ChooseFilesystem(
+	available []string, singlePartitionSize, partitionSize int64, useGpt bool,
+) (string, string) {
+	fat32Reason := "FAT32 formatting tools are not available on this system"
+	if slices.Contains(available, "fat32") {
+		problems := a.CheckCompatibility("fat32", singlePartitionSize)
+		if len(problems) == 0 {
+			target := "UEFI PCs, including those with Secure Boot enabled"
+			if !useGpt {
+				target += ", and legacy BIOS PCs"
+			}
+			return "fat32", "every file fits on FAT32, so a single FAT32 partition will be used, " +
+				"which boots on " + target
+		}
+		fat32Reason = "FAT32 cannot be used, as " + problems[0].Error()
+		if len(problems) > 1 {
+			fat32Reason += fmt.Sprintf(" (and %d more problems)", len(problems)-1)
+		}
+	}
+
+	switch {
+	case slices.Contains(available, "ntfs"):
+		return "ntfs", fat32Reason + ", so NTFS will be used with UEFI:NTFS to boot on UEFI PCs"
+	case slices.Contains(available, "exfat"):
+		return "exfat", fat32Reason + ", and NTFS drivers are not available, so exFAT will be used " +
+			"with UEFI:NTFS to boot on UEFI PCs (except those with Secure Boot enabled)"
+	}
+	// Let the compatibility check report why FAT32 won't work
+	return "fat32", fat32Reason
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	contents := &ContentAnalysis{Entries: []ContentEntry{
+		{Path: "sources", IsDir: true},
+		{Path: "sources/install.wim", Size: 5 * 1024 * 1024 * 1024},
+		{Path: "sources/Boot.wim", Size: 1024},
+		{Path: "sources/boot.wim", Size: 1024},
+		{Path: "setup?.exe", Size: 1024},
+	}}
+	const partitionSize = 64 * 1024 * 1024 * 1024
+
+	problems := contents.CheckCompatibility("fat32", partitionSize)
+	if len(problems) != 3 {
+		t.Fatalf("expected 3 problems on FAT32, got %d: %v", len(problems), problems)
+	}
+	for _, expected := range []string{"sources/install.wim is", "exceeds FAT32", "differ only by case", "contains '?'"} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem.Error(), expected)
+		}
+		if !found {
+			t.Errorf("expected a problem containing %q, got %v", expected, problems)
+		}
+	}
+
+	// NTFS has no file size limit and is case-sensitive with ntfs-3g
+	if problems := contents.CheckCompatibility("ntfs", partitionSize); len(problems) != 1 {
+		t.Errorf("expected 1 problem on NTFS, got %d: %v", len(problems), problems)
+	}
+	if problems := contents.CheckCompatibility("ntfs", 1024*1024*1024); len(problems) != 2 {
+		t.Errorf("expected 2 problems on a small NTFS partition, got %d: %v", len(problems), problems)
+	}
+}
+
+func TestChooseFilesystem(t *testing.T) {
+	contents := &ContentAnalysis{Entries: []ContentEntry{
+		{Path: "sources", IsDir: true},
+		{Path: "sources/boot.wim", Size: 512 * 1024 * 1024},
+	}, TotalSize: 512 * 1024 * 1024}
+	all := []string{"ntfs", "exfat", "fat32"}
+	if fs, _ := contents.ChooseFilesystem(all, 8*1024*1024*1024, 8*1024*1024*1024, false); fs != "fat32" {
+		t.Errorf("expected fat32 when every file fits on FAT32, got %s", fs)
+	}
+	if fs, _ := contents.ChooseFilesystem([]string{"ntfs", "exfat"}, 8*1024*1024*1024, 8*1024*1024*1024, false); fs != "ntfs" {
+		t.Errorf("expected ntfs without FAT32 tools, got %s", fs)
+	}
+
+	contents.Entries = append(contents.Entries, ContentEntry{Path: "sources/install.wim", Size: 5 * 1024 * 1024 * 1024})
+	contents.TotalSize += 5 * 1024 * 1024 * 1024
+	fs, reason := contents.ChooseFilesystem(all, 16*1024*1024*1024, 16*1024*1024*1024, false)
+	if fs != "ntfs" {
+		t.Errorf("expected ntfs when a file exceeds FAT32's limit, got %s", fs)
+	} else if !strings.Contains(reason, "sources/install.wim is") {
+		t.Errorf("expected reason to name the oversized file, got %q", reason)
+	}
+	if fs, _ := contents.ChooseFilesystem([]string{"exfat", "fat32"}, 16*1024*1024*1024, 16*1024*1024*1024, false); fs != "exfat" {
+		t.Errorf("expected exfat without NTFS drivers, got %s", fs)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "github.com/retrixe/udf"
+
+// DOS file attributes, shared by FAT, exFAT and NTFS.
+const (
+	dosAttributeReadOnly  = 0x01
+	dosAttributeHidden    = 0x02
+	dosAttributeSystem    = 0x04
+	dosAttributeDirectory = 0x10
+	dosAttributeArchive   = 0x20
+)
+
+// UDF flags which carry DOS attributes, see ECMA-167 4/14.4.3 and 4/14.6.8.
+const (
+	udfCharacteristicHidden = 0x01
+	udfICBFlagArchive       = 0x20
+	udfICBFlagSystem        = 0x400
+)
+
+// getDOSAttributes maps the attributes of a file on the ISO to DOS attributes, as described in
+// section 3.3.1.1 of the UDF 2.60 specification.
+func getDOSAttributes(file udf.File) uint32 {
+	var attrs uint32
+	if file.Fid != nil && file.Fid.FileCharacteristics&udfCharacteristicHidden != 0 {
+		attrs |= dosAttributeHidden
+	}
+	if entry := file.FileEntry(); entry != nil && entry.ICBTag != nil {
+		if entry.ICBTag.Flags&udfICBFlagArchive != 0 {
+			attrs |= dosAttributeArchive
+		}
+		if entry.ICBTag.Flags&udfICBFlagSystem != 0 {
+			attrs |= dosAttributeSystem
+		}
+	}
+	if file.IsDir() {
+		// Windows ignores the read-only attribute on folders (it's used to mark customised folders),
+		// while Linux FAT drivers would prevent us from writing to them, so don't carry it over.
+		attrs |= dosAttributeDirectory
+	} else if file.Mode().Perm()&0222 == 0 {
+		attrs |= dosAttributeReadOnly // UDF marks read-only files by clearing all write permissions
+	}
+	return attrs
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fatIoctlSetAttributes is FAT_IOCTL_SET_ATTRIBUTES from include/uapi/linux/msdos_fs.h
+const fatIoctlSetAttributes = 0x40047211
+
+// SetDOSAttributes sets the DOS attributes of a file on a mounted FAT, exFAT or NTFS filesystem.
+// Filesystems which don't support setting attributes are silently ignored.
+func SetDOSAttributes(name string, attrs uint32) error {
+	// ntfs-3g and ntfs3 expose DOS attributes as an extended attribute
+	value := binary.LittleEndian.AppendUint32(nil, attrs)
+	err := unix.Setxattr(name, "system.ntfs_attrib", value, 0)
+	if err == nil || !errors.Is(err, unix.EOPNOTSUPP) {
+		return err
+	}
+
+	// vfat (and exFAT on newer kernels) support the FAT attribute ioctls
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = unix.IoctlSetPointerInt(int(file.Fd()), fatIoctlSetAttributes, int(attrs))
+	if errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
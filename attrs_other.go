@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func SetDOSAttributes(name string, attrs uint32) error {
+	return nil
+}
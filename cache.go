@@ -0,0 +1,25 @@
+package main
+
+// ReadGuarantee describes how certain we are that data read back during validation came from the
+// USB drive itself, rather than from a copy kept in memory by the OS.
+type ReadGuarantee int
+
+const (
+	// ReadGuaranteeNone means data may have been served from the page cache.
+	ReadGuaranteeNone ReadGuarantee = iota
+	// ReadGuaranteeDropped means the page cache was flushed and dropped before reading.
+	ReadGuaranteeDropped
+	// ReadGuaranteeDirect means data was read with O_DIRECT, bypassing the page cache entirely.
+	ReadGuaranteeDirect
+)
+
+func (g ReadGuarantee) String() string {
+	switch g {
+	case ReadGuaranteeDirect:
+		return "all files were read directly from the USB drive, bypassing the page cache (O_DIRECT)"
+	case ReadGuaranteeDropped:
+		return "all files were read from the USB drive after dropping the page cache"
+	default:
+		return "files may have been read from the page cache instead of the USB drive"
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// directIOAlignment is the buffer alignment used for O_DIRECT reads. 4096 bytes satisfies the
+// logical block size of both 512-byte and 4Kn devices.
+const directIOAlignment = 4096
+
+// FlushBlockDeviceCache writes back and drops the buffer cache of the given block device, so that
+// subsequent reads (including by FUSE filesystems like ntfs-3g) have to go to the device.
+func FlushBlockDeviceCache(blockDevice string) error {
+	file, err := os.Open(blockDevice)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := unix.IoctlSetInt(int(file.Fd()), unix.BLKFLSBUF, 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fuseSuperMagic is the f_type reported by statfs for FUSE filesystems.
+const fuseSuperMagic = 0x65735546
+
+// OpenUncached opens a file for reading while avoiding the page cache. It tries O_DIRECT first,
+// and falls back to dropping the file's cached pages with POSIX_FADV_DONTNEED if the filesystem
+// doesn't support direct I/O. FUSE filesystems such as ntfs-3g always use the fallback, since even
+// with O_DIRECT, the FUSE daemon reads the block device through its buffer cache.
+func OpenUncached(name string) (*os.File, ReadGuarantee, error) {
+	file, err := os.OpenFile(name, os.O_RDONLY|unix.O_DIRECT, 0)
+	if err == nil {
+		var stat unix.Statfs_t
+		if err := unix.Fstatfs(int(file.Fd()), &stat); err == nil && stat.Type != fuseSuperMagic {
+			return file, ReadGuaranteeDirect, nil
+		}
+		file.Close()
+	} else if !errors.Is(err, unix.EINVAL) {
+		return nil, ReadGuaranteeNone, err
+	}
+	file, err = os.Open(name)
+	if err != nil {
+		return nil, ReadGuaranteeNone, err
+	}
+	if err := unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+		return file, ReadGuaranteeNone, nil
+	}
+	return file, ReadGuaranteeDropped, nil
+}
+
+// NewUncachedReader wraps a file returned by OpenUncached, so that it can be read with buffers of
+// any size or alignment.
+func NewUncachedReader(file *os.File, guarantee ReadGuarantee) io.Reader {
+	return &alignedReader{file: file, buf: newUncachedBuffer(4*1024*1024, guarantee)}
+}
+
+// newUncachedBuffer allocates a buffer which can be used to read a file returned by OpenUncached
+// directly with ReadAt, as long as reads are at offsets aligned to directIOAlignment.
+func newUncachedBuffer(size int, guarantee ReadGuarantee) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	if guarantee == ReadGuaranteeDirect {
+		offset := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+		if offset != 0 {
+			offset = directIOAlignment - offset
+		}
+		buf = buf[offset : offset+size]
+	}
+	return buf[:size]
+}
+
+// alignedReader serves reads of any size from a single aligned buffer, since O_DIRECT only permits
+// reads into buffers aligned to the logical block size of the underlying device.
+type alignedReader struct {
+	file *os.File
+	buf  []byte
+	r, w int
+	err  error
+}
+
+func (a *alignedReader) Read(p []byte) (int, error) {
+	if a.r == a.w {
+		if a.err != nil {
+			return 0, a.err
+		}
+		a.r = 0
+		a.w, a.err = a.file.Read(a.buf)
+		if a.w == 0 {
+			return 0, a.err
+		}
+	}
+	n := copy(p, a.buf[a.r:a.w])
+	a.r += n
+	return n, nil
+}
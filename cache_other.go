@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func FlushBlockDeviceCache(blockDevice string) error {
+	return errors.ErrUnsupported
+}
+
+func OpenUncached(name string) (*os.File, ReadGuarantee, error) {
+	file, err := os.Open(name)
+	return file, ReadGuaranteeNone, err
+}
+
+func NewUncachedReader(file *os.File, guarantee ReadGuarantee) io.Reader {
+	return file
+}
+
+func newUncachedBuffer(size int, guarantee ReadGuarantee) []byte {
+	return make([]byte, size)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// dataPartitionName is the GPT partition name of the data partition.
+const dataPartitionName = "Data"
+
+// dataPartitionMinHeadroom is the least free space left on the sources partition when the data
+// partition takes up the rest of the drive, so that `update` can write a newer ISO to it.
+const dataPartitionMinHeadroom = 1024 * 1024 * 1024
+
+// DataPartition is an extra partition after the partitions glassUSB creates, which is left for
+// logs, tools or anything else once Windows is installed.
+type DataPartition struct {
+	Size       int64 // In bytes, or 0 to use the rest of the drive
+	Filesystem string
+	Label      string
+}
+
+// ParseDataPartition parses a data partition given as <size|rest>:<filesystem>:<label>, where the
+// size is a number of bytes with an optional K, M, G or T suffix (in powers of 1024).
+func ParseDataPartition(value string) (*DataPartition, error) {
+	fields := strings.SplitN(value, ":", 3)
+	if len(fields) != 3 {
+		return nil, errors.New("expected <size|rest>:<filesystem>:<label>")
+	}
+	data := &DataPartition{Filesystem: strings.ToLower(fields[1]), Label: fields[2]}
+	if !strings.EqualFold(fields[0], "rest") {
+		size, err := parseSize(fields[0])
+		if err != nil {
+			return nil, err
+		} else if size < 1024*1024 {
+			return nil, errors.New("data partition must be at least 1 MiB")
+		} else if size > math.MaxInt64-1024*1024 {
+			return nil, fmt.Errorf("size %q is too large", fields[0])
+		}
+		data.Size = (size + 1024*1024 - 1) / (1024 * 1024) * 1024 * 1024 // Align to 1 MiB
+	}
+	if data.Filesystem != "fat32" && data.Filesystem != "exfat" && data.Filesystem != "ntfs" {
+		return nil, fmt.Errorf("unsupported data partition filesystem %q, expected fat32, exfat or ntfs", fields[1])
+	}
+	data.Label = sanitizeLabel(data.Filesystem, data.Label)
+	return data, nil
+}
+
+// parseSize parses a size such as 512M, 1.5G or 16GiB into bytes. Fractions of a byte are dropped.
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value), "B"), "I")
+	shift := uint(0)
+	if index := strings.IndexAny(number, "KMGT"); index >= 0 && index == len(number)-1 {
+		shift = 10 * uint(strings.IndexByte("KMGT", number[index])+1)
+		number = number[:index]
+	}
+	whole, fraction, _ := strings.Cut(number, ".")
+	if whole == "" || !isDigits(whole) || !isDigits(fraction) {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	size, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	size.Mul(size, new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1), shift)))
+	bytes := new(big.Int).Quo(size.Num(), size.Denom())
+	if !bytes.IsInt64() {
+		return 0, fmt.Errorf("size %q is too large", value)
+	} else if bytes.Sign() == 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return bytes.Int64(), nil
+}
+
+func isDigits(value string) bool {
+	return strings.Trim(value, "0123456789") == ""
+}
+
+// SizeDataPartition returns the size in bytes of a data partition taking up the rest of the drive,
+// when the sources partition would otherwise have the given size. The sources partition is shrunk
+// to what the contents need, plus some headroom for newer ISOs.
+func (a *ContentAnalysis) SizeDataPartition(filesystem string, partitionSize int64) (int64, error) {
+	// The space needed depends on the cluster size, which depends on the partition size
+	sourcesSize := a.EstimateUsage(filesystem, partitionSize)
+	for range 2 {
+		usage := a.EstimateUsage(filesystem, sourcesSize)
+		sourcesSize = usage + max(usage/10, dataPartitionMinHeadroom)
+	}
+	sourcesSize = (sourcesSize + 1024*1024 - 1) / (1024 * 1024) * 1024 * 1024
+	if sourcesSize+1024*1024 > partitionSize {
+		return 0, errors.New("drive has no space left for a data partition after the sources partition")
+	}
+	return partitionSize - sourcesSize, nil
+}
+
+// dataPartitionSize returns the size of a data partition, or 0 if there is none.
+func dataPartitionSize(data *DataPartition) int64 {
+	if data == nil {
+		return 0
+	}
+	return data.Size
+}
+
+// FormatDataPartition creates the filesystem of the data partition on a disk partitioned by
+// FormatDiskForSinglePartition or FormatDiskForUEFINTFS.
+func FormatDataPartition(name string, singlePartition bool, data *DataPartition) error {
+	number := 3
+	if singlePartition {
+		number = 2
+	}
+	device, err := GetBlockDevicePartition(name, number)
+	if err != nil {
+		return fmt.Errorf("failed to find data partition: %w", err)
+	}
+	switch data.Filesystem {
+	case "exfat":
+		return MakeExFAT(device, data.Label)
+	case "ntfs":
+		return MakeNTFS(device, data.Label)
+	default:
+		return MakeFAT32(device, data.Label)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDataPartition(t *testing.T) {
+	for value, expected := range map[string]DataPartition{
+		"rest:exfat:Tools":    {Size: 0, Filesystem: "exfat", Label: "Tools"},
+		"16G:NTFS:Logs":       {Size: 16 * 1024 * 1024 * 1024, Filesystem: "ntfs", Label: "Logs"},
+		"1.5GiB:fat32:data":   {Size: 1536 * 1024 * 1024, Filesystem: "fat32", Label: "DATA"},
+		"1500000:exfat:A:B:C": {Size: 2 * 1024 * 1024, Filesystem: "exfat", Label: "A_B_C"},
+	} {
+		data, err := ParseDataPartition(value)
+		if err != nil {
+			t.Errorf("%s: %v", value, err)
+		} else if *data != expected {
+			t.Errorf("%s: expected %+v, got %+v", value, expected, *data)
+		}
+	}
+	for _, value := range []string{"rest:exfat", "16G:ext4:Logs", "512K:ntfs:Logs", "lots:ntfs:Logs", "-1G:ntfs:Logs",
+		"inf:ntfs:Logs", "nan:ntfs:Logs", "1e30:ntfs:Logs", ".5G:ntfs:Logs"} {
+		if _, err := ParseDataPartition(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+	for _, value := range []string{"99999999999T:ntfs:Logs", "9223372036854775807:ntfs:Logs"} {
+		if _, err := ParseDataPartition(value); err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("%s: expected the size to be rejected as too large, got %v", value, err)
+		}
+	}
+}
+
+func TestSizeDataPartition(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	contents := &ContentAnalysis{Entries: []ContentEntry{
+		{Path: "sources", IsDir: true},
+		{Path: "sources/install.wim", Size: 5 * gib},
+	}}
+	const partitionSize = 64 * gib
+	size, err := contents.SizeDataPartition("exfat", partitionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourcesSize := int64(partitionSize - size)
+	if sourcesSize%(1024*1024) != 0 {
+		t.Errorf("sources partition size %d is not aligned to 1 MiB", sourcesSize)
+	} else if usage := contents.EstimateUsage("exfat", sourcesSize); sourcesSize-usage < gib {
+		t.Errorf("sources partition of %d bytes leaves less than 1 GiB free for %d bytes", sourcesSize, usage)
+	} else if sourcesSize > 7*gib {
+		t.Errorf("sources partition of %d bytes is larger than needed", sourcesSize)
+	}
+
+	if _, err := contents.SizeDataPartition("exfat", 6*gib); err == nil {
+		t.Error("expected an error when the drive has no space left for a data partition")
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/retrixe/imprint/imaging"
+)
+
+var doctorCommandFlagSet = flag.NewFlagSet("doctor", flag.ExitOnError)
+
+func init() {
+	doctorCommandFlagSet.Usage = doctorUsage
+}
+
+func doctorUsage() {
+	println("Usage: glassUSB doctor <device path>")
+	println("\nAudit why a USB drive may not boot, without writing anything to it. The partition")
+	println("table, boot records, UEFI:NTFS partition and bootloaders on the drive are inspected,")
+	println("and a checklist of whether the drive will boot in BIOS, UEFI and Secure Boot modes")
+	println("is printed.")
+}
+
+// Names of the checks run by the doctor command, which boot modes are evaluated from.
+const (
+	doctorCheckPartitionTable = "Partition table"
+	doctorCheckPartitionTypes = "Partition types"
+	doctorCheckBootFlag       = "Boot flag"
+	doctorCheckMBRBootCode    = "MBR boot code"
+	doctorCheckVBR            = "Sources partition boot sector"
+	doctorCheckUEFINTFS       = "UEFI:NTFS partition"
+	doctorCheckBootmgr        = "bootmgr"
+	doctorCheckEFIBootloader  = "EFI bootloader"
+	doctorCheckLabel          = "Volume label"
+)
+
+// vbrInspectSize is how much of the start of the sources partition is searched for boot code. The
+// FAT32 boot code glassUSB writes spans 13 sectors, so 64 KiB covers 4Kn drives too.
+const vbrInspectSize = 64 * 1024
+
+var mbrTypeNames = map[mbr.Type]string{
+	mbr.NTFS:      "NTFS/exFAT",
+	mbr.Fat32LBA:  "FAT32 (LBA)",
+	mbr.EFISystem: "EFI System",
+}
+
+// DoctorReport is the result of auditing the bootability of a drive.
+type DoctorReport struct {
+	Checks          []CheckResult
+	useGpt          bool
+	partitions      int
+	primaryOffset   int64 // Offset of the sources partition in bytes, -1 if not found
+	primaryFs       string
+	singlePartition bool
+}
+
+func (r *DoctorReport) add(name string, err error, details string) {
+	r.Checks = append(r.Checks, newCheckResult(name, err, details))
+}
+
+// requires returns an error naming the first of the given checks which failed or was not run.
+func (r *DoctorReport) requires(names ...string) error {
+	for _, name := range names {
+		index := -1
+		for i, check := range r.Checks {
+			if check.Name == name {
+				index = i
+			}
+		}
+		if index == -1 {
+			return fmt.Errorf("%s could not be checked", name)
+		} else if !r.Checks[index].Passed {
+			return fmt.Errorf("%s check failed", name)
+		}
+	}
+	return nil
+}
+
+// InspectDiskBootRecords checks the partition table, MBR, sources partition boot sector and
+// UEFI:NTFS partition of a drive, which can be done without mounting it.
+func InspectDiskBootRecords(name string) *DoctorReport {
+	report := &DoctorReport{primaryOffset: -1}
+	disk, err := openDisk(name, diskfs.ReadOnly)
+	if err != nil {
+		report.add(doctorCheckPartitionTable, fmt.Errorf("failed to open device: %v", err), "")
+		return report
+	}
+	defer disk.Close()
+	table, err := disk.GetPartitionTable()
+	if err != nil {
+		report.add(doctorCheckPartitionTable, fmt.Errorf("failed to read partition table: %w", err), "")
+		return report
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		report.add(doctorCheckPartitionTable, fmt.Errorf("failed to open device: %w", err), "")
+		return report
+	}
+	defer file.Close()
+
+	switch table := table.(type) {
+	case *gpt.Table:
+		report.useGpt = true
+		report.partitions = len(table.Partitions)
+		report.singlePartition = len(table.Partitions) < 2 || table.Partitions[1].Name != "UEFI:NTFS"
+		report.add(doctorCheckPartitionTable, nil, "GPT")
+		types := []string{}
+		err = nil
+		for index, partition := range table.Partitions {
+			types = append(types, fmt.Sprintf("%d: %s (%s)", index+1, partition.Name, partition.Type))
+			if partition.Type != gpt.MicrosoftBasicData && err == nil {
+				err = fmt.Errorf("partition %d has type %s, expected Microsoft basic data (%s)",
+					index+1, partition.Type, gpt.MicrosoftBasicData)
+			}
+		}
+		if len(table.Partitions) > 0 {
+			report.primaryOffset = int64(table.Partitions[0].Start) * disk.LogicalBlocksize
+		}
+		report.add(doctorCheckPartitionTypes, checkPartitionCount(report.partitions, report.singlePartition, err),
+			strings.Join(types, ", "))
+	case *mbr.Table:
+		report.add(doctorCheckPartitionTable, nil, "MBR")
+		partitions := []*mbr.Partition{}
+		for _, partition := range table.Partitions {
+			if partition.Type != mbr.Empty {
+				partitions = append(partitions, partition)
+			}
+		}
+		report.partitions = len(partitions)
+		report.singlePartition = len(partitions) < 2 || partitions[1].Type != mbr.EFISystem
+		expected := []mbr.Type{mbr.NTFS, mbr.EFISystem} // A data partition after these can have any type
+		if report.singlePartition {
+			expected = []mbr.Type{mbr.Fat32LBA}
+		}
+		types := []string{}
+		err = nil
+		for index, partition := range partitions {
+			typeName, ok := mbrTypeNames[partition.Type]
+			if !ok {
+				typeName = "unknown"
+			}
+			types = append(types, fmt.Sprintf("%d: %s (0x%02x)", index+1, typeName, byte(partition.Type)))
+			if index < len(expected) && partition.Type != expected[index] && err == nil {
+				err = fmt.Errorf("partition %d has type 0x%02x, expected 0x%02x", index+1,
+					byte(partition.Type), byte(expected[index]))
+			}
+		}
+		report.add(doctorCheckPartitionTypes, checkPartitionCount(report.partitions, report.singlePartition, err),
+			strings.Join(types, ", "))
+		if len(partitions) > 0 {
+			report.primaryOffset = int64(partitions[0].Start) * disk.LogicalBlocksize
+			if partitions[0].Bootable {
+				report.add(doctorCheckBootFlag, nil, "Partition 1 is marked active")
+			} else {
+				report.add(doctorCheckBootFlag, errors.New("partition 1 is not marked active, BIOS will not boot it"), "")
+			}
+		}
+		report.add(doctorCheckMBRBootCode, checkMBRBootCode(file), "")
+	default:
+		report.add(doctorCheckPartitionTable, fmt.Errorf("unknown partition table type: %s", table.Type()), "")
+		return report
+	}
+
+	if report.primaryOffset >= 0 {
+		report.primaryFs, err = inspectVBR(file, report.primaryOffset, !report.useGpt)
+		details := ""
+		if err == nil {
+			details = getFilesystemName(report.primaryFs)
+			if !report.useGpt {
+				details += " with Windows boot code"
+			}
+		}
+		report.add(doctorCheckVBR, err, details)
+	}
+	if !report.singlePartition {
+		report.add(doctorCheckUEFINTFS, CheckUEFINTFSPartition(name, 2), "")
+	}
+	return report
+}
+
+// checkPartitionCount checks the number of partitions on a drive, allowing for a data partition.
+func checkPartitionCount(partitions int, singlePartition bool, err error) error {
+	if partitions == 0 {
+		return errors.New("no partitions found")
+	} else if singlePartition && partitions > 2 {
+		return fmt.Errorf("expected 1 or 2 partitions, found %d", partitions)
+	} else if partitions > 3 {
+		return fmt.Errorf("expected 2 or 3 partitions, found %d", partitions)
+	}
+	return err
+}
+
+// checkMBRBootCode checks that the MBR of a disk has a boot signature and boot code for BIOS.
+func checkMBRBootCode(file *os.File) error {
+	sector := make([]byte, 512)
+	if _, err := file.ReadAt(sector, 0); err != nil {
+		return fmt.Errorf("failed to read MBR: %w", err)
+	} else if sector[510] != 0x55 || sector[511] != 0xAA {
+		return errors.New("MBR is missing its boot signature (0x55AA)")
+	} else if bytes.Count(sector[:440], []byte{0}) == 440 {
+		return errors.New("MBR has no boot code, BIOS will not boot from this drive")
+	}
+	return nil
+}
+
+// inspectVBR identifies the filesystem on the sources partition from its boot sector, and
+// optionally checks that the boot sector contains boot code which loads bootmgr.
+func inspectVBR(file *os.File, offset int64, checkBootCode bool) (string, error) {
+	vbr := make([]byte, vbrInspectSize)
+	if _, err := file.ReadAt(vbr, offset); err != nil {
+		return "", fmt.Errorf("failed to read boot sector: %w", err)
+	} else if vbr[510] != 0x55 || vbr[511] != 0xAA {
+		return "", errors.New("boot sector is missing its boot signature (0x55AA)")
+	}
+	filesystem := filesystemFromBootSector(vbr)
+	if filesystem == "" {
+		return "", errors.New("unknown filesystem on sources partition")
+	} else if checkBootCode && !bytes.Contains(vbr, []byte("BOOTMGR")) {
+		return filesystem, fmt.Errorf("%s boot sector does not contain Windows boot code which loads bootmgr",
+			getFilesystemName(filesystem))
+	}
+	return filesystem, nil
+}
+
+// InspectSourcesPartition checks the bootloaders and label of the mounted sources partition.
+func (r *DoctorReport) InspectSourcesPartition(primaryPartition string, mountPoint string) {
+	if _, ok := findFileCaseInsensitive(mountPoint, "bootmgr"); ok {
+		r.add(doctorCheckBootmgr, nil, "")
+	} else {
+		r.add(doctorCheckBootmgr, errors.New("bootmgr not found at the root of the sources partition"), "")
+	}
+
+	loaders := []string{}
+	if efi, ok := findFileCaseInsensitive(mountPoint, "efi"); ok {
+		if boot, ok := findFileCaseInsensitive(efi, "boot"); ok {
+			entries, _ := os.ReadDir(boot)
+			for _, entry := range entries {
+				name := strings.ToLower(entry.Name())
+				if !entry.IsDir() && strings.HasPrefix(name, "boot") && strings.HasSuffix(name, ".efi") {
+					loaders = append(loaders, entry.Name())
+				}
+			}
+		}
+	}
+	if len(loaders) > 0 {
+		r.add(doctorCheckEFIBootloader, nil, "efi/boot/"+strings.Join(loaders, ", efi/boot/"))
+	} else {
+		r.add(doctorCheckEFIBootloader, errors.New("no efi/boot/boot*.efi found on the sources partition"), "")
+	}
+
+	label, err := GetFilesystemLabel(primaryPartition)
+	if err == nil && label == "" {
+		label = "(none)"
+	}
+	r.add(doctorCheckLabel, err, label)
+}
+
+// findFileCaseInsensitive finds a file or folder in a folder, ignoring case as FAT and NTFS do.
+func findFileCaseInsensitive(dir string, name string) (string, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name(), name) {
+			return filepath.Join(dir, entry.Name()), true
+		}
+	}
+	return "", false
+}
+
+// BootModes evaluates from the checks whether the drive will boot in BIOS, UEFI and Secure Boot
+// modes, with the reason if it will not.
+func (r *DoctorReport) BootModes() []CheckResult {
+	var biosErr error
+	if r.useGpt {
+		biosErr = errors.New("BIOS cannot boot from GPT drives, flash the drive with MBR instead")
+	} else {
+		biosErr = r.requires(doctorCheckPartitionTypes, doctorCheckBootFlag, doctorCheckMBRBootCode,
+			doctorCheckVBR, doctorCheckBootmgr)
+	}
+
+	uefiErr := r.requires(doctorCheckPartitionTypes, doctorCheckVBR, doctorCheckEFIBootloader)
+	uefiDetails := ""
+	if uefiErr == nil && r.singlePartition {
+		if r.primaryFs != "fat32" {
+			uefiErr = fmt.Errorf("UEFI firmware cannot read %s without UEFI:NTFS", getFilesystemName(r.primaryFs))
+		}
+		uefiDetails = "Firmware loads Windows' bootloader directly from FAT32"
+	} else if uefiErr == nil {
+		uefiErr = r.requires(doctorCheckUEFINTFS)
+		uefiDetails = "Firmware loads UEFI:NTFS, which loads Windows' bootloader from " +
+			getFilesystemName(r.primaryFs)
+	}
+
+	secureBootErr, secureBootDetails := uefiErr, ""
+	if uefiErr == nil && r.singlePartition {
+		secureBootDetails = "Windows' bootloader is signed by Microsoft"
+	} else if uefiErr == nil && r.primaryFs == "exfat" {
+		secureBootErr = errors.New("UEFI:NTFS' exFAT driver is not signed for Secure Boot, " +
+			"disable Secure Boot or flash the drive with NTFS instead")
+	} else if uefiErr == nil {
+		secureBootDetails = "Only if the firmware trusts the Microsoft 3rd party UEFI CA, which signs UEFI:NTFS.\n" +
+			"Some PCs (e.g. Secured-core PCs) only trust Windows by default, so Secure Boot must be\n" +
+			"disabled, or the 3rd party CA allowed in the firmware settings"
+	}
+
+	return []CheckResult{
+		newCheckResult("BIOS / CSM", biosErr, ""),
+		newCheckResult("UEFI", uefiErr, uefiDetails),
+		newCheckResult("UEFI with Secure Boot", secureBootErr, secureBootDetails),
+	}
+}
+
+func doctorCommand() error {
+	log.SetFlags(0)
+	log.SetPrefix("[glassUSB] ")
+
+	doctorCommandFlagSet.Parse(os.Args[2:])
+	args := doctorCommandFlagSet.Args()
+	if len(args) != 1 {
+		doctorCommandFlagSet.Usage()
+		os.Exit(1)
+	}
+	debugBypassChecksEnv := os.Getenv("__GLASSUSB_DEBUG_BYPASS_CHECKS")
+	debugBypassChecks := debugBypassChecksEnv == "true" || debugBypassChecksEnv == "1"
+	if os.Getuid() > 0 && !debugBypassChecks {
+		return fmt.Errorf("glassUSB must be run with root permissions (`sudo`) to read devices, exiting...")
+	}
+	blockDevice := args[0]
+	log.Println("Target device path:", blockDevice)
+	err := imaging.UnmountDevice(blockDevice)
+	if err != nil && err != imaging.ErrNotBlockDevice { // Ignore non-block-device error here
+		return fmt.Errorf("failed to unmount destination device: %w", err)
+	}
+
+	report := InspectDiskBootRecords(blockDevice)
+	if report.primaryOffset >= 0 {
+		primaryPartition, err := GetBlockDevicePartition(blockDevice, 1)
+		if err != nil {
+			report.add(doctorCheckBootmgr, err, "")
+		} else if mountPoint, _, unmount, err := mountSourcesPartition(primaryPartition); err != nil {
+			report.add(doctorCheckBootmgr, err, "")
+		} else {
+			report.InspectSourcesPartition(primaryPartition, mountPoint)
+			unmount()
+		}
+	}
+
+	log.Println("Checks for " + blockDevice + ":")
+	logCheckResults(report.Checks)
+	log.Println("Boot modes:")
+	bootModes := report.BootModes()
+	if failed := logCheckResults(bootModes); failed == len(bootModes) {
+		return fmt.Errorf("this USB drive will not boot in any mode")
+	}
+	return nil
+}
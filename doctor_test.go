@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := os.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.Truncate(img, 64*1024*1024); err != nil {
+		t.Fatal(err)
+	} else if err := FormatDiskForUEFINTFS(img, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkResults := func(report *DoctorReport, expected map[string]bool) {
+		t.Helper()
+		for _, check := range append(report.Checks, report.BootModes()...) {
+			if passed, ok := expected[check.Name]; ok && passed != check.Passed {
+				t.Errorf("expected %s to pass: %v, got %+v", check.Name, passed, check)
+			}
+		}
+	}
+
+	// Freshly partitioned, nothing has been written yet
+	report := InspectDiskBootRecords(img)
+	checkResults(report, map[string]bool{
+		doctorCheckPartitionTable: true, doctorCheckPartitionTypes: true, doctorCheckBootFlag: true,
+		doctorCheckMBRBootCode: false, doctorCheckVBR: false, "BIOS / CSM": false, "UEFI": false,
+	})
+
+	// Write everything a flash would, with stand-ins for the MBR and NTFS boot code
+	file, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteAt([]byte("MBR boot code"), 0)
+	vbr := make([]byte, 512)
+	copy(vbr[3:], "NTFS    ")
+	copy(vbr[400:], "BOOTMGR is missing")
+	vbr[510], vbr[511] = 0x55, 0xAA
+	file.WriteAt(vbr, 1024*1024)
+	if err := WriteUEFINTFSToPartition(img, 2); err != nil {
+		t.Fatal(err)
+	}
+	mountPoint := t.TempDir()
+	os.WriteFile(filepath.Join(mountPoint, "bootmgr"), nil, 0644)
+	os.MkdirAll(filepath.Join(mountPoint, "EFI", "Boot"), 0755)
+	os.WriteFile(filepath.Join(mountPoint, "EFI", "Boot", "bootx64.efi"), nil, 0644)
+
+	report = InspectDiskBootRecords(img)
+	report.InspectSourcesPartition(img+"-nonexistent", mountPoint)
+	checkResults(report, map[string]bool{
+		doctorCheckMBRBootCode: true, doctorCheckVBR: true, doctorCheckUEFINTFS: true,
+		doctorCheckBootmgr: true, doctorCheckEFIBootloader: true,
+		"BIOS / CSM": true, "UEFI": true, "UEFI with Secure Boot": true,
+	})
+
+	// UEFI:NTFS can load Windows from exFAT, but not with Secure Boot enabled
+	copy(vbr[3:], "EXFAT   ")
+	file.WriteAt(vbr, 1024*1024)
+	report = InspectDiskBootRecords(img)
+	report.InspectSourcesPartition(img+"-nonexistent", mountPoint)
+	checkResults(report, map[string]bool{
+		doctorCheckVBR: true, "BIOS / CSM": true, "UEFI": true, "UEFI with Secure Boot": false,
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// EventSchemaVersion is the version of the JSON event schema documented in the README. It is
+// incremented whenever fields are removed or change meaning, but not when fields are added.
+const EventSchemaVersion = 1
+
+// Event types emitted with -progress=json.
+const (
+	EventStart      = "start"
+	EventPhaseStart = "phase_start"
+	EventPhaseEnd   = "phase_end"
+	EventProgress   = "progress"
+	EventNotice     = "notice"
+	EventWarning    = "warning"
+	EventResult     = "result"
+)
+
+// Error codes reported in result events. Failures during a phase are reported as the phase ID
+// followed by "_failed", e.g. "extraction_failed".
+const (
+	ErrorCodeUnknown          = "unknown"
+	ErrorCodeCancelled        = "cancelled"
+	ErrorCodeInvalidOptions   = "invalid_options"
+	ErrorCodePermissionDenied = "permission_denied"
+	ErrorCodeInvalidISO       = "invalid_iso"
+	ErrorCodeInvalidDevice    = "invalid_device"
+	ErrorCodeIncompatible     = "incompatible_contents"
+	ErrorCodeReport           = "report_failed"
+)
+
+// Event is a single line of newline-delimited JSON emitted with -progress=json.
+type Event struct {
+	Version     int       `json:"version"`
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command,omitempty"`
+	AppVersion  string    `json:"appVersion,omitempty"`
+	Phase       int       `json:"phase,omitempty"`
+	TotalPhases int       `json:"totalPhases,omitempty"`
+	PhaseID     string    `json:"phaseId,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	DurationMs  int64     `json:"durationMs,omitempty"`
+
+	Action         string `json:"action,omitempty"`
+	BytesDone      *int64 `json:"bytesDone,omitempty"`
+	BytesTotal     int64  `json:"bytesTotal,omitempty"`
+	File           string `json:"file,omitempty"`
+	FileBytesDone  *int64 `json:"fileBytesDone,omitempty"`
+	FileBytesTotal int64  `json:"fileBytesTotal,omitempty"`
+	OverallPercent *int   `json:"overallPercent,omitempty"`
+
+	Success   *bool  `json:"success,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PhaseTiming records how long a phase took.
+type PhaseTiming struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// EventWriter emits events as newline-delimited JSON, and keeps track of the current phase and
+// the time taken by each phase. If no output is provided, events are only tracked.
+type EventWriter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+
+	phase        int
+	totalPhases  int
+	phaseID      string
+	phaseName    string
+	phaseStarted time.Time
+	overall      int // -1 if not reported
+	timings      []PhaseTiming
+}
+
+// OpenEventOutput returns where events should be written for the given -progress format and
+// -progress-fd file descriptor, or nil if events should not be written.
+func OpenEventOutput(format string, fd int) io.Writer {
+	switch {
+	case format != "json":
+		return nil
+	case fd == 1:
+		return os.Stdout
+	case fd == 2:
+		return os.Stderr
+	}
+	return os.NewFile(uintptr(fd), "progress-fd")
+}
+
+func NewEventWriter(out io.Writer) *EventWriter {
+	events := &EventWriter{overall: -1}
+	if out != nil {
+		events.encoder = json.NewEncoder(out)
+	}
+	return events
+}
+
+func (e *EventWriter) emit(event Event) {
+	if e.encoder == nil {
+		return
+	}
+	event.Version = EventSchemaVersion
+	event.Time = time.Now()
+	_ = e.encoder.Encode(event) // Progress output failing shouldn't stop the flash
+}
+
+// Start emits the start event for a command.
+func (e *EventWriter) Start(command string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.emit(Event{Type: EventStart, Command: command, AppVersion: version})
+}
+
+// StartPhase ends the current phase, if any, and starts a new one.
+func (e *EventWriter) StartPhase(phase, totalPhases int, id, name string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.endPhase()
+	e.phase, e.totalPhases, e.phaseID, e.phaseName = phase, totalPhases, id, name
+	e.phaseStarted = time.Now()
+	e.emit(Event{Type: EventPhaseStart, Phase: phase, TotalPhases: totalPhases, PhaseID: id, Message: name})
+}
+
+func (e *EventWriter) endPhase() {
+	if e.phaseID == "" {
+		return
+	}
+	timing := PhaseTiming{ID: e.phaseID, Name: e.phaseName, DurationMs: time.Since(e.phaseStarted).Milliseconds()}
+	e.timings = append(e.timings, timing)
+	e.emit(Event{Type: EventPhaseEnd, Phase: e.phase, TotalPhases: e.totalPhases, PhaseID: e.phaseID,
+		Message: e.phaseName, DurationMs: timing.DurationMs})
+	e.phaseID = ""
+}
+
+// EndPhase ends the current phase, if any, so that its timing is recorded.
+func (e *EventWriter) EndPhase() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.endPhase()
+}
+
+// SetOverall sets the overall percentage reported with progress events.
+func (e *EventWriter) SetOverall(percentage int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.overall = percentage
+}
+
+// Progress is a ProgressFunc which emits progress events.
+func (e *EventWriter) Progress(update ProgressUpdate) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	event := Event{
+		Type:        EventProgress,
+		Phase:       e.phase,
+		TotalPhases: e.totalPhases,
+		PhaseID:     e.phaseID,
+		Action:      update.Action,
+		BytesDone:   &update.Done,
+		BytesTotal:  update.Total,
+		File:        update.File,
+	}
+	if update.File != "" {
+		event.FileBytesDone, event.FileBytesTotal = &update.FileDone, update.FileSize
+	}
+	if e.overall >= 0 {
+		overall := e.overall
+		event.OverallPercent = &overall
+	}
+	e.emit(event)
+}
+
+// Notice emits an informational message.
+func (e *EventWriter) Notice(message string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.emit(Event{Type: EventNotice, PhaseID: e.phaseID, Message: message})
+}
+
+// Warning emits a warning message.
+func (e *EventWriter) Warning(message string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.emit(Event{Type: EventWarning, PhaseID: e.phaseID, Message: message})
+}
+
+// Result ends the current phase and emits the final result. The error code is ignored if err is
+// nil, and if empty, is derived from the phase the error occurred in.
+func (e *EventWriter) Result(err error, code string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	failedPhase := e.phaseID
+	e.endPhase()
+	success := err == nil
+	event := Event{Type: EventResult, Success: &success}
+	if err != nil {
+		event.Error = err.Error()
+		event.ErrorCode = code
+		if code == "" && failedPhase != "" {
+			event.ErrorCode = failedPhase + "_failed"
+		} else if code == "" {
+			event.ErrorCode = ErrorCodeUnknown
+		}
+	}
+	e.emit(event)
+}
+
+// Timings returns how long each completed phase took.
+func (e *EventWriter) Timings() []PhaseTiming {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return slices.Clone(e.timings)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestEventWriter(t *testing.T) {
+	var output bytes.Buffer
+	events := NewEventWriter(&output)
+	events.Start("flash")
+	events.StartPhase(1, 2, "partitioning", "Partitioning destination drive")
+	events.StartPhase(2, 2, "extraction", "Extracting ISO to sources partition")
+	events.Progress(ProgressUpdate{Action: "extracted", Done: 10, Total: 20, File: "setup.exe", FileDone: 5, FileSize: 10})
+	events.Result(errors.New("failed to copy file setup.exe"), "")
+
+	var decoded []Event
+	for _, line := range bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n")) {
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatalf("failed to decode event %s: %v", line, err)
+		} else if event.Version != EventSchemaVersion {
+			t.Errorf("expected version %d, got %d", EventSchemaVersion, event.Version)
+		}
+		decoded = append(decoded, event)
+	}
+	types := []string{EventStart, EventPhaseStart, EventPhaseEnd, EventPhaseStart, EventProgress, EventPhaseEnd, EventResult}
+	if len(decoded) != len(types) {
+		t.Fatalf("expected %d events, got %d: %s", len(types), len(decoded), output.String())
+	}
+	for index, event := range decoded {
+		if event.Type != types[index] {
+			t.Errorf("expected event %d to be %s, got %s", index, types[index], event.Type)
+		}
+	}
+	if progress := decoded[4]; *progress.BytesDone != 10 || progress.File != "setup.exe" || progress.OverallPercent != nil {
+		t.Errorf("unexpected progress event: %+v", progress)
+	}
+	if result := decoded[6]; *result.Success || result.ErrorCode != "extraction_failed" {
+		t.Errorf("unexpected result event: %+v", result)
+	}
+	if timings := events.Timings(); len(timings) != 2 || timings[1].ID != "extraction" {
+		t.Errorf("unexpected phase timings: %+v", timings)
+	}
+}
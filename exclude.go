@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ExcludePatterns are glob patterns (as accepted by path.Match) for files and folders in the ISO
+// which should not be written to the USB drive. Patterns are matched case-insensitively against the
+// path relative to the root of the ISO, and excluding a folder excludes all of its contents.
+type ExcludePatterns []string
+
+// ParseExcludePatterns normalises and validates the given patterns.
+func ParseExcludePatterns(patterns []string) (ExcludePatterns, error) {
+	exclude := make(ExcludePatterns, 0, len(patterns))
+	for _, pattern := range patterns {
+		normalised := strings.ToLower(strings.Trim(strings.ReplaceAll(pattern, "\\", "/"), "/"))
+		if normalised == "" {
+			return nil, fmt.Errorf("invalid exclude pattern: %q", pattern)
+		} else if _, err := path.Match(normalised, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+		exclude = append(exclude, normalised)
+	}
+	return exclude, nil
+}
+
+// Matches returns whether the file or folder at the given path relative to the ISO root is
+// excluded. Since folders are skipped as a whole, only the path itself needs to be checked.
+func (e ExcludePatterns) Matches(relPath string) bool {
+	relPath = strings.ToLower(relPath)
+	for _, pattern := range e {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+	}
+	return false
+}
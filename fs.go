@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// DetectFilesystem identifies the filesystem on a partition from its boot sector, returning one of
+// "ntfs", "exfat" or "fat32", as used by the `-fs` flag.
+func DetectFilesystem(partition string) (string, error) {
+	file, err := os.Open(partition)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	bootSector := make([]byte, 512)
+	if _, err := file.ReadAt(bootSector, 0); err != nil {
+		return "", err
+	}
+	if filesystem := filesystemFromBootSector(bootSector); filesystem != "" {
+		return filesystem, nil
+	}
+	return "", fmt.Errorf("unknown filesystem on %s", partition)
+}
+
+// filesystemFromBootSector identifies the filesystem a boot sector belongs to, or returns "".
+func filesystemFromBootSector(bootSector []byte) string {
+	switch {
+	case bytes.Equal(bootSector[3:11], []byte("NTFS    ")):
+		return "ntfs"
+	case bytes.Equal(bootSector[3:11], []byte("EXFAT   ")):
+		return "exfat"
+	case bytes.Equal(bootSector[82:90], []byte("FAT32   ")):
+		return "fat32"
+	}
+	return ""
+}
+
+// SetFilesystemLabel changes the label of an unmounted partition, sanitising it for its filesystem.
+func SetFilesystemLabel(partition string, filesystem string, label string) error {
+	label = sanitizeLabel(filesystem, label)
+	switch filesystem {
+	case "ntfs":
+		return SetNTFSLabel(partition, label)
+	case "exfat":
+		return SetExFATLabel(partition, label)
+	case "fat32":
+		return SetFAT32Label(partition, label)
+	}
+	return fmt.Errorf("unknown filesystem: %s", filesystem)
+}
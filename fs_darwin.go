@@ -5,6 +5,7 @@ package main
 import (
 	"fmt"
 	"os/exec"
+	"strings"
 )
 
 func IsFAT32Available() bool {
@@ -42,3 +43,36 @@ func MakeNTFS(device string, label string) error {
 	}
 	return nil
 }
+
+// diskutil can rename volumes on any filesystem it can mount
+func renameVolume(device string, label string) error {
+	if out, err := exec.Command("diskutil", "rename", device, label).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set volume label: %w\noutput: %s", err, out)
+	}
+	return nil
+}
+
+func SetFAT32Label(device string, label string) error {
+	return renameVolume(device, label)
+}
+
+func SetExFATLabel(device string, label string) error {
+	return renameVolume(device, label)
+}
+
+func SetNTFSLabel(device string, label string) error {
+	return renameVolume(device, label)
+}
+
+func GetFilesystemLabel(device string) (string, error) {
+	out, err := exec.Command("diskutil", "info", device).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to read volume label: %w\noutput: %s", err, out)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), "Volume Name:"); ok {
+			return strings.TrimSpace(name), nil
+		}
+	}
+	return "", nil
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"fmt"
 	"os/exec"
+	"strings"
 )
 
 func IsFAT32Available() bool {
@@ -19,6 +20,13 @@ func MakeFAT32(device string, label string) error {
 	return nil
 }
 
+func SetFAT32Label(device string, label string) error {
+	if out, err := exec.Command("fatlabel", device, label).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set FAT32 label: %w\noutput: %s", err, out)
+	}
+	return nil
+}
+
 func IsExFATAvailable() bool {
 	_, err := exec.LookPath("mkfs.exfat")
 	return err == nil
@@ -31,6 +39,13 @@ func MakeExFAT(device string, label string) error {
 	return nil
 }
 
+func SetExFATLabel(device string, label string) error {
+	if out, err := exec.Command("exfatlabel", device, label).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set exFAT label: %w\noutput: %s", err, out)
+	}
+	return nil
+}
+
 func IsNTFSAvailable() bool {
 	_, err := exec.LookPath("mkfs.ntfs")
 	return err == nil
@@ -43,3 +58,20 @@ func MakeNTFS(device string, label string) error {
 	}
 	return nil
 }
+
+func SetNTFSLabel(device string, label string) error {
+	if out, err := exec.Command("ntfslabel", device, label).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set NTFS label: %w\noutput: %s", err, out)
+	}
+	return nil
+}
+
+func GetFilesystemLabel(device string) (string, error) {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "LABEL", device).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		return "", nil // blkid exits with 2 if the filesystem has no label
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read volume label: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
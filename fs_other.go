@@ -27,3 +27,19 @@ func IsNTFSAvailable() bool {
 func MakeNTFS(device string, label string) error {
 	return errors.ErrUnsupported
 }
+
+func SetFAT32Label(device string, label string) error {
+	return errors.ErrUnsupported
+}
+
+func SetExFATLabel(device string, label string) error {
+	return errors.ErrUnsupported
+}
+
+func SetNTFSLabel(device string, label string) error {
+	return errors.ErrUnsupported
+}
+
+func GetFilesystemLabel(device string) (string, error) {
+	return "", errors.ErrUnsupported
+}
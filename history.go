@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// historyFileEnv overrides the location of the history ledger.
+const historyFileEnv = "GLASSUSB_HISTORY_FILE"
+
+// Outcomes of flashes recorded in the history ledger.
+const (
+	HistoryOutcomeSuccess   = "success"
+	HistoryOutcomeFailed    = "failed"
+	HistoryOutcomeCancelled = "cancelled"
+)
+
+// HistoryEntry is a line of the history ledger, recording a single flash or update.
+type HistoryEntry struct {
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Operator   string    `json:"operator,omitempty"`
+	Version    string    `json:"glassusbVersion"`
+	ISOPath    string    `json:"isoPath"`
+	ISOLabel   string    `json:"isoLabel,omitempty"`
+	ISOSHA256  string    `json:"isoSha256,omitempty"`
+	Device     string    `json:"device"`
+	Model      string    `json:"model,omitempty"`
+	Serial     string    `json:"serial,omitempty"`
+	Outcome    string    `json:"outcome"`
+	ErrorCode  string    `json:"errorCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// GetHistoryFile returns the location of the history ledger. Since glassUSB runs as root, it is
+// kept in a system-wide location rather than in the operator's home folder.
+func GetHistoryFile() string {
+	if file := os.Getenv(historyFileEnv); file != "" {
+		return file
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return "/var/lib/glassusb/history.jsonl"
+	case "darwin":
+		return "/Library/Application Support/glassUSB/history.jsonl"
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		configDir = os.TempDir()
+	}
+	return filepath.Join(configDir, "glassUSB", "history.jsonl")
+}
+
+// GetOperator returns the name of the user running glassUSB, looking past sudo.
+func GetOperator() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	} else if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return ""
+}
+
+// AppendHistory appends an entry to the history ledger, creating it if necessary.
+func AppendHistory(name string, entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode history entry: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return fmt.Errorf("failed to create history folder: %w", err)
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+	defer file.Close()
+	// A single write of a whole line, so concurrent flashes don't interleave their entries
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// ReadHistory reads the entries in the history ledger for the given device serial (or all devices
+// if empty) since the given time, in the order they were recorded. Corrupt lines are skipped.
+func ReadHistory(name string, serial string, since time.Time) ([]HistoryEntry, error) {
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	defer file.Close()
+	entries := []HistoryEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry HistoryEntry
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		} else if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Warning: Skipping corrupt line %d of history: %v", line, err)
+			continue
+		}
+		if (serial == "" || strings.EqualFold(entry.Serial, serial)) && !entry.Time.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("failed to read history: %w", err)
+	}
+	return entries, nil
+}
+
+// RepeatedFailures returns how many times each device serial failed to flash, for devices which
+// failed more than once.
+func RepeatedFailures(entries []HistoryEntry) map[string]int {
+	failures := make(map[string]int)
+	for _, entry := range entries {
+		if entry.Outcome == HistoryOutcomeFailed && entry.Serial != "" {
+			failures[entry.Serial]++
+		}
+	}
+	for serial, count := range failures {
+		if count < 2 {
+			delete(failures, serial)
+		}
+	}
+	return failures
+}
+
+// parseHistoryDate parses a date given to `history --since`, either as YYYY-MM-DD in local time or
+// as an RFC 3339 timestamp.
+func parseHistoryDate(value string) (time.Time, error) {
+	if date, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+var historyCommandFlagSet = flag.NewFlagSet("history", flag.ExitOnError)
+var historyDeviceFlag = historyCommandFlagSet.String("device", "",
+	"Only show flashes of the USB drive with this serial number")
+var historySinceFlag = historyCommandFlagSet.String("since", "",
+	"Only show flashes on or after this date, as YYYY-MM-DD or an RFC 3339 timestamp")
+var historyJSONFlag = historyCommandFlagSet.Bool("json", false,
+	"Print matching entries as newline-delimited JSON instead of a table")
+
+func init() {
+	historyCommandFlagSet.Usage = historyUsage
+}
+
+func historyUsage() {
+	println("Usage: glassUSB history [options]")
+	println("\nShow the history of flashes and updates performed on this computer, which glassUSB records in")
+	println(GetHistoryFile() + " (or the file given by the " + historyFileEnv + " environment variable).")
+	println("\nOptions:")
+	historyCommandFlagSet.PrintDefaults()
+}
+
+func historyCommand() error {
+	log.SetFlags(0)
+	log.SetPrefix("[glassUSB] ")
+	historyCommandFlagSet.Parse(os.Args[2:])
+	if historyCommandFlagSet.NArg() != 0 {
+		historyCommandFlagSet.Usage()
+		os.Exit(1)
+	}
+	var since time.Time
+	if *historySinceFlag != "" {
+		var err error
+		if since, err = parseHistoryDate(*historySinceFlag); err != nil {
+			log.Println("Invalid value provided for `-since` flag!")
+			historyCommandFlagSet.Usage()
+			os.Exit(1)
+		}
+	}
+
+	entries, err := ReadHistory(GetHistoryFile(), *historyDeviceFlag, since)
+	if err != nil {
+		return err
+	}
+	if *historyJSONFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if len(entries) == 0 {
+		log.Println("No flashes found in history.")
+		return nil
+	}
+
+	fmt.Printf("%-19s  %-7s  %-28s  %-20s  %-24s  %-16s  %s\n",
+		"TIME", "COMMAND", "OUTCOME", "SERIAL", "ISO", "SHA-256", "OPERATOR")
+	for _, entry := range entries {
+		iso := entry.ISOLabel
+		if iso == "" {
+			iso = filepath.Base(entry.ISOPath)
+		}
+		outcome := entry.Outcome
+		if entry.ErrorCode != "" {
+			outcome += " (" + entry.ErrorCode + ")"
+		}
+		fmt.Printf("%-19s  %-7s  %-28s  %-20s  %-24s  %-16s  %s\n", entry.Time.Local().Format(time.DateTime),
+			entry.Command, outcome,
+			orDefault(entry.Serial, "unknown"), truncateString(iso, 24), truncateString(entry.ISOSHA256, 16),
+			entry.Operator)
+	}
+	if *historyDeviceFlag != "" {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].Outcome == HistoryOutcomeSuccess {
+				fmt.Printf("\nLast successfully flashed on %s with %s (SHA-256 %s).\n",
+					entries[i].Time.Local().Format(time.DateTime), entries[i].ISOPath, orDefault(entries[i].ISOSHA256, "unknown"))
+				break
+			}
+		}
+	}
+	if failures := RepeatedFailures(entries); len(failures) > 0 {
+		fmt.Println("\nUSB drives which failed to flash more than once:")
+		for _, serial := range slices.Sorted(maps.Keys(failures)) {
+			fmt.Printf("  %s: %d failures\n", serial, failures[serial])
+		}
+	}
+	return nil
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
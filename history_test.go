@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "glassusb", "history.jsonl")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []HistoryEntry{
+		{Time: start, Serial: "STICK42", Outcome: HistoryOutcomeFailed, ErrorCode: "extraction_failed"},
+		{Time: start.Add(time.Hour), Serial: "STICK42", Outcome: HistoryOutcomeFailed, ErrorCode: "validation_failed"},
+		{Time: start.Add(2 * time.Hour), Serial: "STICK7", Outcome: HistoryOutcomeFailed},
+		{Time: start.Add(48 * time.Hour), Serial: "stick42", Outcome: HistoryOutcomeSuccess, ISOSHA256: "abcd"},
+	}
+	for _, entry := range entries {
+		if err := AppendHistory(name, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Corrupt lines, e.g. from a crash while writing, are skipped
+	file, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	file.WriteString("{\"time\":\n")
+	file.Close()
+
+	all, err := ReadHistory(name, "", time.Time{})
+	if err != nil || len(all) != 4 {
+		t.Fatalf("expected 4 entries, got %d (error %v)", len(all), err)
+	}
+	stick, _ := ReadHistory(name, "STICK42", time.Time{})
+	if len(stick) != 3 || stick[2].ISOSHA256 != "abcd" {
+		t.Errorf("expected 3 entries for STICK42 matching case-insensitively, got %+v", stick)
+	}
+	recent, _ := ReadHistory(name, "", start.Add(24*time.Hour))
+	if len(recent) != 1 {
+		t.Errorf("expected 1 entry since the next day, got %+v", recent)
+	}
+	if failures := RepeatedFailures(all); len(failures) != 1 || failures["STICK42"] != 2 {
+		t.Errorf("expected only STICK42 to have repeated failures, got %v", failures)
+	}
+	if missing, err := ReadHistory(name+".missing", "", time.Time{}); err != nil || len(missing) != 0 {
+		t.Errorf("expected missing history to be empty, got %v (error %v)", missing, err)
+	}
+}
+
+func TestParseHistoryDate(t *testing.T) {
+	if date, err := parseHistoryDate("2026-03-04"); err != nil || date.Day() != 4 || date.Location() != time.Local {
+		t.Errorf("expected local date, got %v (error %v)", date, err)
+	}
+	if date, err := parseHistoryDate("2026-03-04T05:06:07Z"); err != nil || date.Hour() != 5 {
+		t.Errorf("expected RFC 3339 timestamp, got %v (error %v)", date, err)
+	}
+	if _, err := parseHistoryDate("yesterday"); err == nil {
+		t.Error("expected invalid date to be rejected")
+	}
+}
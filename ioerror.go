@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// ioRetryAttempts is the number of times an operation failing with a transient I/O error is
+	// attempted before giving up.
+	ioRetryAttempts = 5
+	// ioRetryBackoff is the delay before the first retry, which doubles with every retry after.
+	ioRetryBackoff = 500 * time.Millisecond
+)
+
+var (
+	ErrDeviceGone = errors.New("the drive was disconnected")
+	ErrNoSpace    = errors.New("the drive is out of space")
+)
+
+// FileIOError is returned when reading or writing a file fails, recording where in the file the
+// failure occurred.
+type FileIOError struct {
+	Op     string // "read" or "write"
+	Offset int64
+	Err    error
+}
+
+func (e *FileIOError) Error() string {
+	return fmt.Sprintf("%s failed at offset %d: %v", e.Op, e.Offset, e.Err)
+}
+
+func (e *FileIOError) Unwrap() error {
+	return e.Err
+}
+
+// classifyIOError wraps errors indicating that the device was disconnected or ran out of space
+// with ErrDeviceGone or ErrNoSpace respectively.
+func classifyIOError(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENODEV), errors.Is(err, syscall.ENXIO):
+		return fmt.Errorf("%w: %w", ErrDeviceGone, err)
+	case errors.Is(err, syscall.ENOSPC):
+		return fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+	return err
+}
+
+// isTransientIOError reports whether an operation which failed with the given error may succeed if
+// it is retried, as is often the case with EIO from cheap USB drives and hubs.
+func isTransientIOError(err error) bool {
+	return errors.Is(err, syscall.EIO)
+}
+
+// IsDeviceGone reports whether an error was caused by the given device being disconnected. Since
+// writes to a disconnected device often fail with EIO rather than ENODEV, the device is checked
+// for as well.
+func IsDeviceGone(err error, device string) bool {
+	if errors.Is(err, ErrDeviceGone) {
+		return true
+	} else if !isTransientIOError(err) {
+		return false
+	}
+	_, statErr := os.Stat(device)
+	return errors.Is(statErr, os.ErrNotExist)
+}
+
+// ioRetrier waits with exponential backoff between retries of transient I/O errors.
+type ioRetrier struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// Wait waits before the next retry, returning false if no attempts are left or the context was
+// cancelled while waiting.
+func (r *ioRetrier) Wait(ctx context.Context) bool {
+	r.attempts++
+	if r.attempts >= ioRetryAttempts {
+		return false
+	} else if r.backoff == 0 {
+		r.backoff = ioRetryBackoff
+	} else {
+		r.backoff *= 2
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(r.backoff):
+		return true
+	}
+}
+
+// retryIO runs an I/O operation, retrying it with backoff if it fails with a transient error.
+func retryIO(ctx context.Context, op func() error) error {
+	retrier := ioRetrier{}
+	for {
+		err := op()
+		if err == nil || !isTransientIOError(err) || !retrier.Wait(ctx) {
+			return err
+		}
+	}
+}
+
+// writeChunkAt writes a chunk to a file at the given offset, retrying transient errors.
+func writeChunkAt(ctx context.Context, dst *os.File, chunk []byte, offset int64) (int, error) {
+	written := 0
+	err := retryIO(ctx, func() error {
+		n, err := dst.WriteAt(chunk[written:], offset+int64(written))
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// deviceReconnectTimeout is how long to wait for a disconnected device to be reconnected.
+const deviceReconnectTimeout = 2 * time.Minute
+
+// WaitForDevice waits until the given device node exists, e.g. after the device was reconnected.
+func WaitForDevice(ctx context.Context, device string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(device); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not appear within %s", device, timeout)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyIOError(t *testing.T) {
+	if err := classifyIOError(&os.PathError{Op: "write", Path: "x", Err: syscall.ENODEV}); !errors.Is(err, ErrDeviceGone) {
+		t.Errorf("expected ENODEV to be classified as device gone, got %v", err)
+	}
+	if err := classifyIOError(syscall.ENOSPC); !errors.Is(err, ErrNoSpace) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected ENOSPC to be classified as out of space, got %v", err)
+	}
+	if err := classifyIOError(syscall.EIO); errors.Is(err, ErrDeviceGone) || !isTransientIOError(err) {
+		t.Errorf("expected EIO to be left as a transient error, got %v", err)
+	}
+}
+
+func TestRetryIO(t *testing.T) {
+	attempts := 0
+	err := retryIO(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return syscall.EIO
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("expected transient error to be retried once, got %v after %d attempts", err, attempts)
+	}
+
+	attempts = 0
+	err = retryIO(context.Background(), func() error {
+		attempts++
+		return syscall.ENOSPC
+	})
+	if !errors.Is(err, syscall.ENOSPC) || attempts != 1 {
+		t.Errorf("expected ENOSPC not to be retried, got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestCopyFileContents(t *testing.T) {
+	data := bytes.Repeat([]byte("glassUSB"), 3*1024*1024) // Spans several buffers
+	dst, err := os.Create(filepath.Join(t.TempDir(), "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	progress := &Progress{}
+	hash, err := copyFileContents(context.Background(), io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), dst, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHash := sha256.Sum256(data)
+	if !bytes.Equal(hash, expectedHash[:]) {
+		t.Errorf("hash does not match the source")
+	} else if progress.Load() != int64(len(data)) {
+		t.Errorf("expected progress of %d bytes, got %d", len(data), progress.Load())
+	}
+	if written, err := os.ReadFile(dst.Name()); err != nil || !bytes.Equal(written, data) {
+		t.Errorf("written file does not match the source: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// See include/uapi/linux/ioprio.h
+const (
+	ioprioWhoProcess    = 1
+	ioprioClassShift    = 13
+	ioprioClassBE       = 2
+	ioprioClassIdle     = 3
+	ioprioBELowestLevel = 7
+)
+
+// SetIOPriorityClass sets the I/O scheduling class of every thread in this process, like ionice(1).
+// Threads created afterwards inherit the class from the thread which created them.
+func SetIOPriorityClass(class string) error {
+	var ioprio int
+	switch class {
+	case "idle":
+		ioprio = ioprioClassIdle << ioprioClassShift
+	case "best-effort":
+		ioprio = ioprioClassBE<<ioprioClassShift | ioprioBELowestLevel
+	default:
+		return fmt.Errorf("unknown I/O scheduling class: %s", class)
+	}
+
+	// I/O priorities are per-thread on Linux, and Go may run us on any of our threads
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio))
+		if errno != 0 && errno != unix.ESRCH { // Ignore threads which exited in the meantime
+			return errno
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func SetIOPriorityClass(class string) error {
+	return errors.ErrUnsupported
+}
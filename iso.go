@@ -3,21 +3,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"sync/atomic"
+	"slices"
 	"time"
 
 	"github.com/diskfs/go-diskfs"
-	"github.com/retrixe/imprint/imaging"
 	"github.com/retrixe/udf"
 )
 
 var ErrInvalidWindowsISO = errors.New("this file is not recognised as a valid Windows ISO image in UDF format")
 
+// FileHashes maps the slash-separated path of each file relative to the ISO root to its SHA-256
+// hash, as computed while the file was being extracted.
+type FileHashes map[string][]byte
+
 func OpenWindowsISO(file *os.File) (*udf.Udf, error) {
 	if !IsValidWindowsISO(file) {
 		return nil, ErrInvalidWindowsISO
@@ -49,23 +54,19 @@ func isFileUDF(file *os.File) bool {
 	return err == nil && iso != nil && len(iso.ReadDir(nil)) > 0
 }
 
-func GetISOContentSize(iso *udf.Udf) int64 {
-	size := int64(0)
-	for _, file := range iso.ReadDir(nil) {
-		if file.IsDir() {
-			size += getISOFileFolderSize(file)
-		} else {
-			size += file.Size()
-		}
-	}
-	return size
+// GetISOContentSize returns the total size of all files in the ISO which are not excluded.
+func GetISOContentSize(iso *udf.Udf, exclude ExcludePatterns) int64 {
+	return getISOFolderSize(iso.ReadDir(nil), "", exclude)
 }
 
-func getISOFileFolderSize(folder udf.File) int64 {
+func getISOFolderSize(files []udf.File, relPath string, exclude ExcludePatterns) int64 {
 	var size int64 = 0
-	for _, f := range folder.ReadDir() {
-		if f.IsDir() {
-			size += getISOFileFolderSize(f)
+	for _, f := range files {
+		filePath := path.Join(relPath, f.Name())
+		if exclude.Matches(filePath) {
+			continue
+		} else if f.IsDir() {
+			size += getISOFolderSize(f.ReadDir(), filePath, exclude)
 		} else {
 			size += f.Size()
 		}
@@ -73,188 +74,463 @@ func getISOFileFolderSize(folder udf.File) int64 {
 	return size
 }
 
-func logProgressPerSecond(ctx context.Context, logFn func(string), action string, progress *atomic.Int64) {
-	startTime := time.Now().UnixMilli()
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			logFn(imaging.FormatProgress(int(progress.Load()), time.Now().UnixMilli()-startTime, action, false) + "\r")
-		case <-ctx.Done():
-			logFn(imaging.FormatProgress(int(progress.Load()), time.Now().UnixMilli()-startTime, action, true) + "\n")
-			return
-		}
-	}
-}
-
-func ExtractISOToLocation(ctx context.Context, logFn func(string), iso *udf.Udf, location string) error {
-	progress := &atomic.Int64{}
+// ExtractISOToLocation extracts all files in the ISO to the given location, returning the SHA-256
+// hash of each file's contents, which can be used to validate the written files later without
+// reading the ISO a second time.
+//
+// If a journal is provided, each extracted file is recorded in it, and files which the journal
+// records as already extracted are skipped if they still match the hash recorded in the journal,
+// in case they were not fully written to the disk or were changed since.
+func ExtractISOToLocation(ctx context.Context, logFn ProgressFunc, iso *udf.Udf, location string, exclude ExcludePatterns, journal *FlashJournal) (FileHashes, error) {
+	progress := &Progress{}
 	progressCtx, cancelProgress := context.WithCancel(ctx)
 	defer cancelProgress()
-	go logProgressPerSecond(progressCtx, logFn, "extracted", progress)
+	go logProgressPerSecond(progressCtx, logFn, "extracted", progress, GetISOContentSize(iso, exclude))
+	hashes := make(FileHashes)
 	for _, file := range iso.ReadDir(nil) {
-		if err := extractISOFileToLocation(ctx, file, location, progress); err != nil {
-			return err
+		if err := extractISOFileToLocation(ctx, file, location, "", exclude, hashes, journal, progress); err != nil {
+			return nil, err
 		} else if ctx.Err() != nil {
-			return fmt.Errorf("operation cancelled")
+			return nil, fmt.Errorf("operation cancelled")
 		}
 	}
-	return nil
+	return hashes, nil
 }
 
-func extractISOFileToLocation(ctx context.Context, file udf.File, location string, progress *atomic.Int64) error {
-	if file.IsDir() {
+func extractISOFileToLocation(ctx context.Context, file udf.File, location string, relPath string, exclude ExcludePatterns, hashes FileHashes, journal *FlashJournal, progress *Progress) error {
+	relPath = path.Join(relPath, file.Name())
+	if exclude.Matches(relPath) {
+		return nil
+	} else if file.IsDir() {
 		folderPath := filepath.Join(location, file.Name())
 		if err := os.MkdirAll(folderPath, file.Mode().Perm()); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", folderPath, err)
 		}
 		for _, child := range file.ReadDir() {
-			if err := extractISOFileToLocation(ctx, child, folderPath, progress); err != nil {
+			if err := extractISOFileToLocation(ctx, child, folderPath, relPath, exclude, hashes, journal, progress); err != nil {
 				return err
 			} else if ctx.Err() != nil {
 				return fmt.Errorf("operation cancelled")
 			}
 		}
+		// Apply metadata once all children are written, since writing them updates the folder mtime
+		if err := applyISOFileMetadata(file, folderPath); err != nil {
+			return err
+		}
 	} else {
-		newFile, err := os.Create(filepath.Join(location, file.Name()))
+		filePath := filepath.Join(location, file.Name())
+		if journal != nil {
+			if expectedHash, size, ok := journal.Completed(relPath); ok && size == file.Size() {
+				if hash, err := hashFile(filePath); err == nil && bytes.Equal(hash, expectedHash) {
+					hashes[relPath] = hash
+					progress.Add(size)
+					return nil
+				}
+			}
+		}
+		if _, err := os.Lstat(filePath); err == nil {
+			// A previous attempt may have marked the file read-only before it could be recorded
+			_ = SetDOSAttributes(filePath, 0)
+		}
+		newFile, err := os.Create(filePath)
 		if err != nil {
 			return fmt.Errorf("failed to create file %s: %w", file.Name(), err)
 		}
 		defer newFile.Close()
-		buf := make([]byte, 4*1024*1024)
-		src := file.NewReader()
-		dst := newFile
-		syncInterval := 8
-		// Extracted from io.CopyBuffer
-		// errInvalidWrite means that a write returned an impossible count.
-		var errInvalidWrite = errors.New("invalid write result")
-		for {
-			if ctx.Err() != nil {
-				return fmt.Errorf("operation cancelled") // Modified from io.CopyBuffer to support cancellation
-			}
-			nr, er := src.Read(buf)
-			if nr > 0 {
-				nw, ew := dst.Write(buf[0:nr])
-				if nw < 0 || nr < nw {
-					nw = 0
-					if ew == nil {
-						ew = errInvalidWrite
-					}
-				}
-				progress.Add(int64(nw)) // Modified from io.CopyBuffer to track progress
-				if ew != nil {
-					err = ew
-					break
-				}
-				if nr != nw {
-					err = io.ErrShortWrite
-					break
-				}
-			}
-			if er != nil {
-				if er != io.EOF {
-					err = er
-				}
-				break
-			}
-			// Modified from io.CopyBuffer to run regular syncs to disk
-			syncInterval--
-			if syncInterval == 0 {
-				err = newFile.Sync()
-				if err != nil {
-					break
-				}
-				syncInterval = 8
+		progress.StartFile(relPath, file.Size())
+		hash, err := copyFileContents(ctx, file.NewReader(), newFile, progress)
+		if ctx.Err() != nil {
+			return fmt.Errorf("operation cancelled")
+		} else if err != nil {
+			return fmt.Errorf("failed to copy file %s: %w", file.Name(), err)
+		}
+		hashes[relPath] = hash
+		if err := applyISOFileMetadata(file, filePath); err != nil {
+			return err
+		}
+		if journal != nil {
+			if err := journal.Record(relPath, file.Size(), hashes[relPath]); err != nil {
+				return err
 			}
 		}
-		if err != nil {
-			return fmt.Errorf("failed to copy file %s: %w", file.Name(), err)
+	}
+	return nil
+}
+
+// copyFileContents copies a file to the destination while hashing its contents, and returns the
+// SHA-256 hash of the contents once they have been synced to disk.
+//
+// Transient I/O errors are retried with backoff. If writing data back to disk fails, the data not
+// yet confirmed to be on disk is rewritten from the source before retrying.
+func copyFileContents(ctx context.Context, src *io.SectionReader, dst *os.File, progress *Progress) ([]byte, error) {
+	buf := make([]byte, 4*1024*1024)
+	hash := sha256.New()
+	writeBack := newWriteBackController(src, dst)
+	retrier := ioRetrier{}
+	var offset, hashed int64
+	for done := false; !done; {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("operation cancelled")
+		}
+		var nr int
+		er := retryIO(ctx, func() (err error) {
+			nr, err = src.ReadAt(buf, offset)
+			return err
+		})
+		if er != nil && er != io.EOF {
+			return nil, &FileIOError{Op: "read", Offset: offset, Err: classifyIOError(er)}
+		}
+		// Data rewritten after writing it back failed has already been hashed
+		if skip := hashed - offset; int64(nr) > skip {
+			hash.Write(buf[skip:nr])
+			hashed = offset + int64(nr)
+		}
+		nw, ew := writeChunkAt(ctx, dst, buf[:nr], offset)
+		progress.Add(int64(nw))
+		if ew != nil {
+			return nil, &FileIOError{Op: "write", Offset: offset + int64(nw), Err: classifyIOError(ew)}
+		}
+		offset += int64(nw)
+
+		done = er == io.EOF
+		var err error
+		if done {
+			err = writeBack.Finish()
+		} else {
+			err = writeBack.Add(nw)
 		}
-		err = newFile.Sync()
 		if err != nil {
-			return fmt.Errorf("failed to sync file %s: %w", file.Name(), err)
+			rewound := writeBack.Rewind()
+			if !isTransientIOError(err) || !retrier.Wait(ctx) {
+				return nil, &FileIOError{Op: "write", Offset: rewound, Err: classifyIOError(err)}
+			}
+			progress.Add(rewound - offset)
+			offset, done = rewound, false
+		}
+	}
+	return hash.Sum(nil), nil
+}
+
+// hashFile returns the SHA-256 hash of the contents of a file.
+func hashFile(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// applyISOFileMetadata applies the modification time and DOS attributes of a file on the ISO to the
+// extracted file, so that the USB drive matches media created by Microsoft's own tools.
+func applyISOFileMetadata(file udf.File, name string) error {
+	if modTime := file.ModTime(); !modTime.IsZero() {
+		if err := os.Chtimes(name, time.Time{}, modTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", name, err)
 		}
 	}
+	if err := SetDOSAttributes(name, getDOSAttributes(file)); err != nil {
+		return fmt.Errorf("failed to set attributes of %s: %w", name, err)
+	}
 	return nil
 }
 
-func ValidateISOAgainstLocation(ctx context.Context, logFn func(string), iso *udf.Udf, location string) error {
-	progress := &atomic.Int64{}
+// ValidateISOAgainstLocation checks that the files at the given location match the ISO, and the
+// overlay if one is provided, as thoroughly as the validation mode requires. With ValidationFull,
+// if hashes are provided, only the destination is read and compared against them, otherwise the
+// contents of each file are compared byte-by-byte against the source.
+//
+// Files are read while avoiding the page cache where possible, and the weakest guarantee achieved
+// across all files is returned.
+func ValidateISOAgainstLocation(ctx context.Context, logFn ProgressFunc, iso *udf.Udf, location string, exclude ExcludePatterns, mode ValidationMode, hashes FileHashes, overlay Overlay) (ReadGuarantee, error) {
+	if mode != ValidationFull {
+		hashes = nil // Hashes can only be compared against if files are read in full
+	}
+	progress := &Progress{}
 	progressCtx, cancelProgress := context.WithCancel(ctx)
 	defer cancelProgress()
-	go logProgressPerSecond(progressCtx, logFn, "validated", progress)
+	go logProgressPerSecond(progressCtx, logFn, "validated", progress,
+		AnalyzeContents(iso, exclude, overlay).ValidationReadSize(mode))
 
 	// Eschew checking for extra files at the top level, since OSes like macOS and Windows will just
 	// create garbage like .DS_Store and 'System Volume Information' folders (typically at the root).
 	//
 	// This check is mostly there for sanity, I don't think we really need it either as long as the
 	// the ISO files are all in correct order.
+	guarantee := ReadGuaranteeDirect
 	for _, file := range iso.ReadDir(nil) {
-		if err := validateISOFileAgainstLocation(ctx, file, location, progress); err != nil {
-			return err
+		if err := validateISOFileAgainstLocation(ctx, file, location, "", exclude, mode, hashes, overlay, progress, &guarantee); err != nil {
+			return guarantee, err
 		} else if ctx.Err() != nil {
-			return fmt.Errorf("operation cancelled")
+			return guarantee, fmt.Errorf("operation cancelled")
 		}
 	}
-	return nil
+	for relPath, file := range overlay {
+		if file.IsDir {
+			continue
+		}
+		name := filepath.Join(location, filepath.FromSlash(relPath))
+		progress.StartFile(relPath, validationReadSize(mode, file.Size))
+		var err error
+		if mode == ValidationSize || hashes != nil {
+			err = validateFile(ctx, mode, name, file.Size, hashes[relPath], nil, progress, &guarantee)
+		} else if srcFile, openErr := os.Open(file.Source); openErr != nil {
+			err = fmt.Errorf("failed to open overlay file %s: %w", file.Source, openErr)
+		} else {
+			err = validateFile(ctx, mode, name, file.Size, nil, srcFile, progress, &guarantee)
+			srcFile.Close()
+		}
+		if err != nil {
+			return guarantee, err
+		} else if ctx.Err() != nil {
+			return guarantee, fmt.Errorf("operation cancelled")
+		}
+	}
+	return guarantee, nil
 }
 
-func validateISOFileAgainstLocation(ctx context.Context, file udf.File, location string, progress *atomic.Int64) error {
-	if file.IsDir() {
+func validateISOFileAgainstLocation(ctx context.Context, file udf.File, location string, relPath string, exclude ExcludePatterns, mode ValidationMode, hashes FileHashes, overlay Overlay, progress *Progress, guarantee *ReadGuarantee) error {
+	relPath = path.Join(relPath, file.Name())
+	if exclude.Matches(relPath) {
+		return nil
+	} else if file.IsDir() {
 		folderPath := filepath.Join(location, file.Name())
 		validNames := make(map[string]struct{})
 		for _, child := range file.ReadDir() {
+			if exclude.Matches(path.Join(relPath, child.Name())) {
+				continue // Excluded files should not be present, so they're not valid names either
+			}
 			validNames[child.Name()] = struct{}{}
-			if err := validateISOFileAgainstLocation(ctx, child, folderPath, progress); err != nil {
+			if err := validateISOFileAgainstLocation(ctx, child, folderPath, relPath, exclude, mode, hashes, overlay, progress, guarantee); err != nil {
 				return err
 			} else if ctx.Err() != nil {
 				return fmt.Errorf("operation cancelled")
 			}
 		}
-		// Check if there's extra files in location that are not in ISO
+		// Check if there's extra files in location that are not in ISO (or the overlay)
 		contents, err := os.ReadDir(folderPath)
 		if err != nil {
 			return fmt.Errorf("failed to read directory %s: %w", folderPath, err)
 		}
 		for _, entry := range contents {
-			if _, ok := validNames[entry.Name()]; !ok {
+			if _, ok := validNames[entry.Name()]; !ok && !overlay.Contains(path.Join(relPath, entry.Name())) {
 				return fmt.Errorf("extra file %s found in directory %s that is not in the ISO", entry.Name(), folderPath)
 			}
 		}
+	} else if overlay.Contains(relPath) {
+		return nil // Replaced by an overlay file, which is validated separately
 	} else {
-		srcReader := file.NewReader()
-		destFile, err := os.Open(filepath.Join(location, file.Name()))
-		if err != nil {
-			return fmt.Errorf("failed to open file %s: %w", file.Name(), err)
+		expectedHash, ok := hashes[relPath]
+		if hashes != nil && !ok {
+			return fmt.Errorf("no hash was recorded for file %s during extraction", relPath)
 		}
-		defer destFile.Close()
-		buf1 := make([]byte, 4*1024*1024)
-		buf2 := make([]byte, 4*1024*1024)
-		for {
-			if ctx.Err() != nil {
-				return fmt.Errorf("operation cancelled")
+		progress.StartFile(relPath, validationReadSize(mode, file.Size()))
+		return validateFile(ctx, mode, filepath.Join(location, file.Name()), file.Size(), expectedHash, file.NewReader(), progress, guarantee)
+	}
+	return nil
+}
+
+// validateFile checks a single file with the given validation mode, against its expected hash if
+// one is given, or otherwise against its source.
+func validateFile(ctx context.Context, mode ValidationMode, name string, size int64, expectedHash []byte, src io.ReaderAt, progress *Progress, guarantee *ReadGuarantee) error {
+	switch {
+	case mode == ValidationSize:
+		return validateFileSize(name, size, progress)
+	case mode == ValidationSample:
+		return validateFileSamples(ctx, src, name, size, progress, guarantee)
+	case expectedHash != nil:
+		return validateFileHash(ctx, name, size, expectedHash, progress, guarantee)
+	default:
+		return validateFileContents(ctx, io.NewSectionReader(src, 0, size), name, progress, guarantee)
+	}
+}
+
+// validateFileHash checks that a file has the expected size and SHA-256 hash.
+func validateFileHash(ctx context.Context, name string, expectedSize int64, expectedHash []byte, progress *Progress, guarantee *ReadGuarantee) error {
+	destFile, fileGuarantee, err := OpenUncached(name)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", name, err)
+	}
+	defer destFile.Close()
+	*guarantee = min(*guarantee, fileGuarantee)
+	if stat, err := destFile.Stat(); err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", name, err)
+	} else if stat.Size() != expectedSize {
+		return fmt.Errorf("file %s on disk is %d bytes, expected %d bytes", name, stat.Size(), expectedSize)
+	}
+	hash := sha256.New()
+	destReader := NewUncachedReader(destFile, fileGuarantee)
+	buf := make([]byte, 4*1024*1024)
+	for {
+		if ctx.Err() != nil {
+			return fmt.Errorf("operation cancelled")
+		}
+		n, err := destReader.Read(buf)
+		hash.Write(buf[:n])
+		progress.Add(int64(n))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read file %s from destination: %w", name, err)
+		}
+	}
+	if !bytes.Equal(hash.Sum(nil), expectedHash) {
+		return fmt.Errorf("contents of file %s do not match the source", name)
+	}
+	return nil
+}
+
+// validateFileContents compares a file byte-by-byte against its source.
+func validateFileContents(ctx context.Context, srcReader io.Reader, name string, progress *Progress, guarantee *ReadGuarantee) error {
+	destFile, fileGuarantee, err := OpenUncached(name)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", name, err)
+	}
+	defer destFile.Close()
+	*guarantee = min(*guarantee, fileGuarantee)
+	destReader := NewUncachedReader(destFile, fileGuarantee)
+	buf1 := make([]byte, 4*1024*1024)
+	buf2 := make([]byte, 4*1024*1024)
+	for {
+		if ctx.Err() != nil {
+			return fmt.Errorf("operation cancelled")
+		}
+		n1, err1 := srcReader.Read(buf1)
+		if err1 != nil && err1 != io.EOF {
+			return fmt.Errorf("failed to read file %s from source: %w", name, err1)
+		}
+		n2, err2 := io.ReadFull(destReader, buf2[:n1])
+		if err2 != nil { // EOF should not happen here
+			return fmt.Errorf("failed to read file %s from destination: %w", name, err2)
+		}
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return fmt.Errorf("contents of file %s do not match the source", name)
+		}
+		progress.Add(int64(n1))
+		if err1 == io.EOF {
+			break
+		}
+	}
+	n, err := destReader.Read(buf2)
+	if n > 0 || err != io.EOF {
+		return fmt.Errorf("file %s on disk is larger than expected", name)
+	}
+	return nil
+}
+
+// ignoredRootEntries are files and folders which OSes or glassUSB create at the root of removable
+// drives, and which are left alone when updating a drive from an ISO.
+var ignoredRootEntries = []string{
+	"System Volume Information", "$RECYCLE.BIN", ".Trashes", ".Spotlight-V100", ".fseventsd",
+	".DS_Store", journalFileName, manifestFileName,
+}
+
+// UpdateLocationFromISO brings the files at the given location in line with the ISO, copying only
+// files whose size or contents differ, and deleting files which are not in the ISO or the overlay.
+// The SHA-256 hash of each file's contents is returned, for validation afterwards.
+func UpdateLocationFromISO(ctx context.Context, logFn ProgressFunc, iso *udf.Udf, location string, exclude ExcludePatterns, overlay Overlay) (FileHashes, error) {
+	progress := &Progress{}
+	progressCtx, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	go logProgressPerSecond(progressCtx, logFn, "processed", progress, GetISOContentSize(iso, exclude))
+	hashes := make(FileHashes)
+	if err := updateISOFolderAtLocation(ctx, iso.ReadDir(nil), location, "", exclude, hashes, overlay, progress); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func updateISOFolderAtLocation(ctx context.Context, files []udf.File, location string, relPath string, exclude ExcludePatterns, hashes FileHashes, overlay Overlay, progress *Progress) error {
+	validNames := make(map[string]struct{})
+	for _, file := range files {
+		if exclude.Matches(path.Join(relPath, file.Name())) {
+			continue // Excluded files are deleted along with files not in the ISO
+		}
+		validNames[file.Name()] = struct{}{}
+		name := filepath.Join(location, file.Name())
+		stat, err := os.Stat(name)
+		if err == nil && stat.IsDir() != file.IsDir() {
+			if err := removeFromLocation(name); err != nil {
+				return err
 			}
-			n1, err1 := srcReader.Read(buf1)
-			if err1 != nil && err1 != io.EOF {
-				return fmt.Errorf("failed to read file %s from ISO: %w", file.Name(), err1)
+		}
+
+		if file.IsDir() {
+			if err := os.MkdirAll(name, file.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", name, err)
 			}
-			n2, err2 := io.ReadFull(destFile, buf2[:n1])
-			if err2 != nil { // EOF should not happen here
-				return fmt.Errorf("failed to read file %s from destination: %w", file.Name(), err2)
+			if err := updateISOFolderAtLocation(ctx, file.ReadDir(), name, path.Join(relPath, file.Name()), exclude, hashes, overlay, progress); err != nil {
+				return err
 			}
-			if !bytes.Equal(buf1[:n1], buf2[:n2]) {
-				return fmt.Errorf("contents of file %s do not match the ISO", file.Name())
+			if err := applyISOFileMetadata(file, name); err != nil {
+				return err
 			}
-			progress.Add(int64(n1))
-			if err1 == io.EOF {
-				break
+		} else if unchanged, hash := isISOFileUnchangedAtLocation(file, name); unchanged {
+			hashes[path.Join(relPath, file.Name())] = hash
+			if err := applyISOFileMetadata(file, name); err != nil {
+				return err
 			}
+			progress.Add(file.Size())
+		} else if err := extractISOFileToLocation(ctx, file, location, relPath, exclude, hashes, nil, progress); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("operation cancelled")
 		}
-		n, err := destFile.Read(buf2)
-		if n > 0 || err != io.EOF {
-			return fmt.Errorf("file %s on disk is larger than expected", file.Name())
+	}
+
+	// Delete files in location that are not in the ISO or the overlay
+	contents, err := os.ReadDir(location)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", location, err)
+	}
+	for _, entry := range contents {
+		if _, ok := validNames[entry.Name()]; ok || overlay.Contains(path.Join(relPath, entry.Name())) {
+			continue
+		} else if relPath == "" && slices.Contains(ignoredRootEntries, entry.Name()) {
+			continue
+		}
+		if err := removeFromLocation(filepath.Join(location, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isISOFileUnchangedAtLocation checks whether a file on the ISO has the same size and contents as
+// the file at the given path, returning the hash of its contents if so.
+func isISOFileUnchangedAtLocation(file udf.File, name string) (bool, []byte) {
+	stat, err := os.Stat(name)
+	if err != nil || stat.Size() != file.Size() {
+		return false, nil
+	}
+	destHash, err := hashFile(name)
+	if err != nil {
+		return false, nil
+	}
+	srcHash := sha256.New()
+	if _, err := io.Copy(srcHash, file.NewReader()); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(destHash, srcHash.Sum(nil)), destHash
+}
+
+// removeFromLocation deletes a file or folder, clearing DOS attributes such as read-only first.
+func removeFromLocation(name string) error {
+	_ = filepath.WalkDir(name, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = SetDOSAttributes(path, dosAttributeDirectory)
+		} else if err == nil {
+			_ = SetDOSAttributes(path, 0)
 		}
+		return nil
+	})
+	if err := os.RemoveAll(name); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
 	}
 	return nil
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// journalFileName is the name of the flash journal, stored at the root of the sources partition.
+// Extra files at the root are ignored during validation, so it doesn't need special handling there.
+const journalFileName = "glassusb-journal.jsonl"
+
+// journalVersion is the version of the flash journal format, and journals of other versions are
+// treated as belonging to a different flash.
+const journalVersion = 2
+
+// fingerprintChunkSize is how much of the start and end of the ISO is hashed for its fingerprint.
+const fingerprintChunkSize = 1024 * 1024
+
+// ErrNoFlashJournal is returned when resuming a flash on a drive which has no flash journal.
+var ErrNoFlashJournal = errors.New("no interrupted flash was found on this drive")
+
+// FlashJournalHeader identifies the flash a journal belongs to, and is stored on its first line.
+type FlashJournalHeader struct {
+	Version        int    `json:"version"`
+	ISOSize        int64  `json:"isoSize"`
+	ISOLabel       string `json:"isoLabel"`
+	ISOFingerprint string `json:"isoFingerprint"`
+	Filesystem     string `json:"filesystem"`
+	GPT            bool   `json:"gpt"`
+	Exclude        string `json:"exclude,omitempty"`
+	Overlay        string `json:"overlay,omitempty"`
+	DataPartition  string `json:"dataPartition,omitempty"`
+}
+
+// GetISOFingerprint returns a fingerprint of an ISO which is cheap to compute, from its size,
+// modification time and the contents of its first and last MiB, which hold the UDF descriptors.
+func GetISOFingerprint(file *os.File) (string, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	binary.Write(hash, binary.LittleEndian, stat.Size())
+	binary.Write(hash, binary.LittleEndian, stat.ModTime().UnixNano())
+	chunk := make([]byte, min(fingerprintChunkSize, stat.Size()))
+	for _, offset := range []int64{0, stat.Size() - int64(len(chunk))} {
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return "", fmt.Errorf("failed to read ISO: %w", err)
+		}
+		hash.Write(chunk)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// GetOverlayFingerprint returns a fingerprint of the files in an overlay from their paths, sizes and
+// modification times, or an empty string if there is no overlay.
+func GetOverlayFingerprint(overlay Overlay) string {
+	if len(overlay) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, relPath := range slices.Sorted(maps.Keys(overlay)) {
+		file := overlay[relPath]
+		fmt.Fprintf(hash, "%s\x00%t\x00%d\x00%d\n", relPath, file.IsDir, file.Size, file.ModTime.UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+type flashJournalEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// FlashJournal records each file along with its SHA-256 hash once it has been fully extracted and
+// synced to the USB drive, so that an interrupted flash can resume extraction from where it left off.
+//
+// The journal is stored as newline-delimited JSON, and each entry is synced to disk before the next
+// file is extracted. A torn final line (e.g. from power loss) is ignored when opening the journal.
+type FlashJournal struct {
+	file      *os.File
+	completed map[string]flashJournalEntry
+}
+
+// CreateFlashJournal creates a new, empty flash journal at the given location.
+func CreateFlashJournal(location string, header FlashJournalHeader) (*FlashJournal, error) {
+	header.Version = journalVersion
+	file, err := os.Create(filepath.Join(location, journalFileName))
+	if err != nil {
+		return nil, err
+	}
+	journal := &FlashJournal{file: file, completed: make(map[string]flashJournalEntry)}
+	if err := journal.append(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return journal, nil
+}
+
+// OpenFlashJournal opens an existing flash journal at the given location for appending, after
+// checking that it belongs to a flash with the same parameters.
+func OpenFlashJournal(location string, header FlashJournalHeader) (*FlashJournal, error) {
+	header.Version = journalVersion
+	file, err := os.OpenFile(filepath.Join(location, journalFileName), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoFlashJournal
+	} else if err != nil {
+		return nil, err
+	}
+	journal := &FlashJournal{file: file, completed: make(map[string]flashJournalEntry)}
+
+	scanner := bufio.NewScanner(file)
+	var existingHeader FlashJournalHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &existingHeader) != nil {
+		file.Close()
+		return nil, fmt.Errorf("flash journal is corrupt")
+	} else if existingHeader != header {
+		file.Close()
+		return nil, fmt.Errorf("interrupted flash used a different ISO or options (%s, %s, GPT: %t)",
+			existingHeader.ISOLabel, existingHeader.Filesystem, existingHeader.GPT)
+	}
+	validLength := int64(len(scanner.Bytes()) + 1)
+	for scanner.Scan() {
+		var entry flashJournalEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			break
+		}
+		journal.completed[entry.Path] = entry
+		validLength += int64(len(scanner.Bytes()) + 1)
+	}
+	// Drop a torn last line, so that new entries are appended after the last valid one
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(min(validLength, stat.Size())); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if validLength > stat.Size() { // The last valid line is missing its newline
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return journal, nil
+}
+
+// RemoveFlashJournal deletes the flash journal at the given location, if any.
+func RemoveFlashJournal(location string) error {
+	err := os.Remove(filepath.Join(location, journalFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Completed returns the hash of a file if it was recorded as fully extracted in the journal.
+func (j *FlashJournal) Completed(path string) ([]byte, int64, bool) {
+	entry, ok := j.completed[path]
+	if !ok {
+		return nil, 0, false
+	}
+	hash, err := hex.DecodeString(entry.SHA256)
+	if err != nil {
+		return nil, 0, false
+	}
+	return hash, entry.Size, true
+}
+
+// Record appends a fully extracted file to the journal, and syncs the journal to disk.
+func (j *FlashJournal) Record(path string, size int64, hash []byte) error {
+	entry := flashJournalEntry{Path: path, Size: size, SHA256: hex.EncodeToString(hash)}
+	if err := j.append(entry); err != nil {
+		return fmt.Errorf("failed to write flash journal: %w", err)
+	}
+	j.completed[path] = entry
+	return nil
+}
+
+func (j *FlashJournal) append(value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close closes the journal file.
+func (j *FlashJournal) Close() error {
+	return j.file.Close()
+}
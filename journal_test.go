@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFlashJournalHeader(t *testing.T) {
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "windows.iso")
+	os.WriteFile(iso, make([]byte, 3*1024*1024), 0644)
+	file, err := os.Open(iso)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fingerprint, err := GetISOFingerprint(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := FlashJournalHeader{ISOSize: 3 * 1024 * 1024, ISOLabel: "CCCOMA_X64FRE_EN-US_DV9",
+		ISOFingerprint: fingerprint, Filesystem: "ntfs"}
+	journal, err := CreateFlashJournal(dir, header)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := journal.Record("setup.exe", 4, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	// A different build of the ISO with the same size and label must not be resumed onto
+	rebuilt := make([]byte, 3*1024*1024)
+	rebuilt[len(rebuilt)-1] = 1
+	os.WriteFile(iso, rebuilt, 0644)
+	if changed, err := GetISOFingerprint(file); err != nil || changed == fingerprint {
+		t.Errorf("expected the fingerprint to change with the end of the ISO, got %s (%v)", changed, err)
+	}
+	changed := header
+	changed.Overlay = GetOverlayFingerprint(Overlay{"autounattend.xml": {Size: 1, ModTime: time.Unix(1, 0)}})
+	if _, err := OpenFlashJournal(dir, changed); err == nil {
+		t.Error("expected a journal with a different overlay to be rejected")
+	}
+
+	journal, err = OpenFlashJournal(dir, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if hash, size, ok := journal.Completed("setup.exe"); !ok || size != 4 || len(hash) != 4 {
+		t.Errorf("expected setup.exe to be recorded with its hash, got %v, %d, %t", hash, size, ok)
+	}
+}
@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	_ "embed"
 
@@ -35,6 +40,10 @@ func mainUsage() {
 	println("\nAvailable commands:")
 	println("  flash       Flash a Windows ISO to a specific USB device.")
 	println("  wizard      (Beta) Start a GUI wizard for flashing Windows ISOs to a USB device.")
+	println("  update      Update a USB drive flashed by glassUSB to a newer Windows ISO.")
+	println("  verify      Check a USB drive flashed by glassUSB against a Windows ISO or its manifest.")
+	println("  doctor      Audit why a USB drive may not boot in BIOS, UEFI or Secure Boot mode.")
+	println("  history     Show the history of flashes and updates performed on this computer.")
 	println("\nOptions:")
 	flag.PrintDefaults()
 }
@@ -42,9 +51,12 @@ func mainUsage() {
 var flashFlagSet = flag.NewFlagSet("flash", flag.ExitOnError)
 var gptFlag = flashFlagSet.Bool("gpt", false,
 	"EXPERIMENTAL: Use GPT partitioning instead of MBR.\n"+
-		"Note: Only compatible with UEFI systems i.e. PCs with Windows 8 or newer")
+		"Note: Only compatible with UEFI systems i.e. PCs with Windows 8 or newer\n"+
+		"MBR can only use the first 2 TiB of larger drives (or 16 TiB with 4096-byte sectors)")
 var fsFlag = flashFlagSet.String("fs", "",
 	"Filesystem to use for storing the USB flash drive contents.\n"+
+		"\nIf set to auto, FAT32 will be used if every file in the ISO fits on it, as it boots\n"+
+		"on PCs with Secure Boot enabled without UEFI:NTFS. Otherwise, NTFS will be used.\n"+
 		"\nIf using NTFS or exFAT, UEFI:NTFS will be installed to an EFI system partition,\n"+
 		"and all ISO files will be placed on the NTFS/exFAT partition.\n"+
 		"Note: Drives formatted with exFAT will not boot on PCs with Secure Boot enabled.\n"+
@@ -56,6 +68,60 @@ var fsFlag = flashFlagSet.String("fs", "",
 		"\nAvailable options: ")
 var skipValidationFlag = flashFlagSet.Bool("skip-validation", false,
 	"Skip validation of written files")
+var resumeFlag = flashFlagSet.Bool("resume", false,
+	"Resume an interrupted flash to the same device with the same ISO and options,\n"+
+		"reusing the existing partitions and any files which were fully written")
+var ioniceFlag = flashFlagSet.String("ionice", "",
+	"I/O scheduling class to run with, so that flashing doesn't slow down other programs.\n"+
+		"\nidle: Only access disks when no other program needs to.\n"+
+		"best-effort: Access disks with the lowest best-effort priority.\n"+
+		"\nAvailable options: idle, best-effort")
+var progressFlag = flashFlagSet.String("progress", "text",
+	"Format to report progress in.\n"+
+		"\ntext: Human-readable progress on the terminal.\n"+
+		"json: Newline-delimited JSON events (documented in the README), written to the file\n"+
+		"descriptor given by -progress-fd. Human-readable progress is still logged to stderr.\n"+
+		"\nAvailable options: text, json")
+var progressFdFlag = flashFlagSet.Int("progress-fd", 1,
+	"File descriptor to write JSON progress events to, stdout by default")
+var reportFlag = flashFlagSet.String("report", "",
+	"File to write a JSON report to after a successful flash, recording the ISO, device,\n"+
+		"layout, phase timings and validation result for audits")
+var reportKeyFlag = flashFlagSet.String("report-key", "",
+	"PKCS #8 private key in PEM format to sign the report with, e.g. an Ed25519 key. The\n"+
+		"signature is written alongside the report, with .sig appended to its name")
+var hashISOFlag = flashFlagSet.Bool("hash-iso", false,
+	"Hash the whole ISO while flashing, to record its SHA-256 hash in the manifest and history.\n"+
+		"This reads the ISO a second time alongside extraction. Implied by -report.")
+var verifyFlag = flashFlagSet.String("verify", "full",
+	"Method used to validate written files.\n"+
+		"\nnone: Skip validation, same as -skip-validation.\n"+
+		"size: Only check that all files and folders exist with the expected sizes.\n"+
+		"sample: Compare the start, end and 8 random 1 MiB chunks of every file against the ISO.\n"+
+		"full: Compare files on the USB drive against hashes computed during extraction.\n"+
+		"compare: Compare files on the USB drive byte-by-byte against the ISO (slower).\n"+
+		"hash: Alias for full.\n"+
+		"\nAvailable options: none, size, sample, full, compare, hash")
+var dataPartitionFlag = flashFlagSet.String("data-partition", "",
+	"Extra partition to create at the end of the drive for logs and tools, given as\n"+
+		"<size|rest>:<fs>:<label>, e.g. 'rest:exfat:Tools' or '16G:ntfs:Logs'. With 'rest',\n"+
+		"the sources partition is shrunk to what the ISO needs plus some headroom.\n"+
+		"\nAvailable filesystems: fat32, exfat, ntfs")
+
+// stringListFlag is a flag which can be specified multiple times, collecting all values.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var overlayFlag stringListFlag
+var excludeFlag stringListFlag
 
 func flashUsage() {
 	println("Usage: glassUSB flash [options] <disk image file> <device path>")
@@ -86,6 +152,13 @@ var UEFI_NTFS_IMG []byte
 func init() {
 	flag.Usage = mainUsage
 	flashFlagSet.Usage = flashUsage
+	flashFlagSet.Var(&overlayFlag, "overlay",
+		"Folder whose contents are copied onto the USB drive after the ISO is extracted.\n"+
+			"Can be specified multiple times. Files in the overlay replace files in the ISO.")
+	flashFlagSet.Var(&excludeFlag, "exclude",
+		"Glob pattern for files and folders in the ISO which should not be written, matched\n"+
+			"case-insensitively against their path in the ISO, e.g. 'support' or 'sources/*.cab'.\n"+
+			"Can be specified multiple times.")
 }
 
 func main() {
@@ -102,6 +175,22 @@ func main() {
 		if err := flashCommand(true); err != nil {
 			log.Fatalln(err)
 		}
+	} else if len(os.Args) >= 2 && os.Args[1] == "update" {
+		if err := updateCommand(); err != nil {
+			log.Fatalln(err)
+		}
+	} else if len(os.Args) >= 2 && os.Args[1] == "verify" {
+		if err := verifyCommand(); err != nil {
+			log.Fatalln(err)
+		}
+	} else if len(os.Args) >= 2 && os.Args[1] == "doctor" {
+		if err := doctorCommand(); err != nil {
+			log.Fatalln(err)
+		}
+	} else if len(os.Args) >= 2 && os.Args[1] == "history" {
+		if err := historyCommand(); err != nil {
+			log.Fatalln(err)
+		}
 	} else {
 		flag.Usage()
 		os.Exit(1)
@@ -110,10 +199,16 @@ func main() {
 
 func flashCommand(wizard bool) error {
 	log.SetFlags(0)
-	log.SetOutput(os.Stderr)
+	renderer := NewProgressRenderer(os.Stderr)
+	defer renderer.Close()
+	log.SetOutput(renderer)
 	log.SetPrefix("[glassUSB] ")
 	var dlg zenity.ProgressDialog
+	ctx := context.Background()
+	events := NewEventWriter(nil)
+	errorCode := ErrorCodeInvalidOptions
 	logProgress := func(message string) {
+		renderer.SetPhase(message)
 		log.Println(message)
 		if dlg != nil {
 			dlg.Text(message)
@@ -121,6 +216,7 @@ func flashCommand(wizard bool) error {
 	}
 	logWarn := func(format string, v ...any) {
 		log.Printf(format, v...)
+		events.Warning(fmt.Sprintf(format, v...))
 		if wizard {
 			zenity.Warning(fmt.Sprintf(format, v...),
 				zenity.Width(640),
@@ -130,8 +226,27 @@ func flashCommand(wizard bool) error {
 				zenity.OKLabel("Continue"))
 		}
 	}
+	logNotice := func(format string, v ...any) {
+		log.Printf(format, v...)
+		events.Notice(fmt.Sprintf(format, v...))
+		if wizard {
+			zenity.Info(fmt.Sprintf(format, v...),
+				zenity.Width(640),
+				zenity.WindowIcon(zenity.InfoIcon),
+				zenity.Title("glassUSB Media Creation Wizard"),
+				zenity.Icon(zenity.InfoIcon),
+				zenity.OKLabel("Continue"))
+		}
+	}
+	recordHistory := func(err error) {} // Set once the drive is about to be written to
 	logError := func(format string, v ...any) error {
 		err := fmt.Errorf(format, v...)
+		recordHistory(err)
+		if ctx.Err() != nil {
+			events.Result(err, ErrorCodeCancelled)
+		} else {
+			events.Result(err, errorCode)
+		}
 		if wizard {
 			zenity.Error(imaging.CapitalizeString(err.Error()),
 				zenity.Width(640),
@@ -158,9 +273,9 @@ func flashCommand(wizard bool) error {
 		supportedFilesystems = append(supportedFilesystems, "fat32")
 	}
 	if len(supportedFilesystems) > 0 {
-		fsFlagStruct.DefValue = supportedFilesystems[0]
-		fsFlagStruct.Value.Set(supportedFilesystems[0])
-		fsFlagStruct.Usage = fsFlagStruct.Usage + strings.Join(supportedFilesystems, ", ")
+		fsFlagStruct.DefValue = "auto"
+		fsFlagStruct.Value.Set("auto")
+		fsFlagStruct.Usage = fsFlagStruct.Usage + "auto, " + strings.Join(supportedFilesystems, ", ")
 	}
 
 	// Parse flags
@@ -169,33 +284,83 @@ func flashCommand(wizard bool) error {
 	if (wizard && len(args) != 0) || (!wizard && len(args) != 2) {
 		flashFlagSet.Usage()
 		os.Exit(1)
-	} else if fsFlag == nil || (*fsFlag != "exfat" && *fsFlag != "ntfs" && *fsFlag != "fat32" && *fsFlag != "") {
+	} else if fsFlag == nil || (*fsFlag != "auto" && *fsFlag != "exfat" && *fsFlag != "ntfs" && *fsFlag != "fat32" && *fsFlag != "") {
 		log.Println("Invalid value provided for `-fs` flag!")
 		flashFlagSet.Usage()
 		os.Exit(1)
-	} else if *fsFlag == "" {
+	} else if _, _, err := ParseValidationMode(*verifyFlag, *skipValidationFlag); err != nil {
+		log.Println("Invalid value provided for `-verify` flag!")
+		flashFlagSet.Usage()
+		os.Exit(1)
+	} else if *ioniceFlag != "" && *ioniceFlag != "idle" && *ioniceFlag != "best-effort" {
+		log.Println("Invalid value provided for `-ionice` flag!")
+		flashFlagSet.Usage()
+		os.Exit(1)
+	} else if (*progressFlag != "text" && *progressFlag != "json") || *progressFdFlag < 0 {
+		log.Println("Invalid value provided for `-progress` or `-progress-fd` flag!")
+		flashFlagSet.Usage()
+		os.Exit(1)
+	} else if *reportKeyFlag != "" && *reportFlag == "" {
+		log.Println("The `-report-key` flag can only be used with `-report`!")
+		flashFlagSet.Usage()
+		os.Exit(1)
+	}
+	validationMode, compareWithISO, _ := ParseValidationMode(*verifyFlag, *skipValidationFlag)
+	*skipValidationFlag = validationMode == ValidationNone
+	events = NewEventWriter(OpenEventOutput(*progressFlag, *progressFdFlag))
+	if wizard {
+		events.Start("wizard")
+	} else {
+		events.Start("flash")
+	}
+	if *fsFlag == "" {
 		return logError("this system does not have any filesystem drivers supported by glassUSB, exiting...")
-	} else if !slices.Contains(supportedFilesystems, *fsFlag) {
+	} else if *fsFlag != "auto" && !slices.Contains(supportedFilesystems, *fsFlag) {
 		return logError("this system does not have drivers for the specified filesystem (%s), exiting...", *fsFlag)
 	}
+	exclude, err := ParseExcludePatterns(excludeFlag)
+	if err != nil {
+		return logError("%w", err)
+	}
+	var reportKey crypto.Signer
+	if *reportKeyFlag != "" {
+		if reportKey, err = LoadReportKey(*reportKeyFlag); err != nil {
+			return logError("%w", err)
+		}
+	}
+	var dataPartition *DataPartition
+	if *dataPartitionFlag != "" {
+		if dataPartition, err = ParseDataPartition(*dataPartitionFlag); err != nil {
+			return logError("invalid value provided for `-data-partition` flag: %w", err)
+		} else if !slices.Contains(supportedFilesystems, dataPartition.Filesystem) {
+			return logError("this system does not have drivers for the data partition filesystem (%s), exiting...",
+				dataPartition.Filesystem)
+		}
+	}
 	debugBypassChecksEnv := os.Getenv("__GLASSUSB_DEBUG_BYPASS_CHECKS")
 	debugBypassChecks := debugBypassChecksEnv == "true" || debugBypassChecksEnv == "1"
 
 	// Check for root permissions before proceeding
 	if os.Getuid() > 0 && !debugBypassChecks {
+		errorCode = ErrorCodePermissionDenied
 		return logError("glassUSB must be run with root permissions (`sudo`) to write to devices, exiting...")
 	}
 
+	// Lower I/O priority if requested
+	if *ioniceFlag != "" {
+		if err := SetIOPriorityClass(*ioniceFlag); err != nil {
+			logWarn("Warning: Failed to set I/O scheduling class to %s: %v", *ioniceFlag, err)
+		}
+	}
+
 	// Warn about exFAT and FAT32 limitations
 	addendum := "If you encounter any issues, try installing NTFS drivers on your system (Paragon NTFS for macOS, ntfs-3g for Linux)."
 	if fullySupportedFsAvailable {
 		addendum = "If you encounter any issues, try using NTFS instead."
 	}
-	switch *fsFlag {
-	case "exfat":
+	// FAT32's 4 GB file size limit is checked against the ISO contents before partitioning
+	if *fsFlag == "exfat" {
 		logWarn("%s %s", "Warning: Drives formatted with exFAT (--fs=exfat) will not boot on PCs with Secure Boot enabled.", addendum)
-	case "fat32":
-		logWarn("%s %s", "Warning: Using FAT32 (--fs=fat32) may cause flashing to fail for ISOs larger than 4 GB in size.", addendum)
 	}
 
 	// If using the wizard, prompt user for ISO and device
@@ -336,8 +501,7 @@ The following device will be converted into a Windows installation USB drive:
 			zenity.WindowIcon(zenity.InfoIcon),
 			zenity.Title("glassUSB Media Creation Wizard"),
 			zenity.Icon(zenity.NoIcon),
-			zenity.Pulsate(),
-			// TODO: Could we use TimeRemaining at the flash stage
+			zenity.TimeRemaining(),
 			zenity.CancelLabel("Cancel"),
 			zenity.OKLabel("Finish"))
 		if err != nil {
@@ -353,18 +517,6 @@ The following device will be converted into a Windows installation USB drive:
 		log.Println("Target device path:", args[1])
 	}
 
-	totalPhasesNum := 7
-	if *gptFlag {
-		totalPhasesNum-- // Skip MBR writing phase
-	}
-	if *skipValidationFlag {
-		totalPhasesNum-- // Skip validation phase
-	}
-	if *fsFlag == "fat32" {
-		totalPhasesNum-- // Skip UEFI:NTFS writing phase
-	}
-	totalPhases := strconv.Itoa(totalPhasesNum)
-	currentPhase := 0
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt,
 		syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	defer cancel()
@@ -375,9 +527,9 @@ The following device will be converted into a Windows installation USB drive:
 		}
 	}()
 
-	// Step 1: Read ISO
-	currentPhase++
-	logProgress("Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Reading ISO")
+	// Read the ISO and check it against the destination drive before touching the drive
+	logProgress("Reading ISO and checking destination drive")
+	errorCode = ErrorCodeInvalidISO
 	file, err := os.Open(args[0])
 	if err != nil {
 		return logError("failed to open ISO: %w", err)
@@ -387,21 +539,51 @@ The following device will be converted into a Windows installation USB drive:
 	if err != nil {
 		return logError("failed to stat ISO file: %w", err)
 	}
+	isoFingerprint, err := GetISOFingerprint(file) // Identifies the ISO when resuming a flash
+	if err != nil {
+		return logError("%w", err)
+	}
 	iso, err := OpenWindowsISO(file)
 	if err != nil {
 		return logError("failed to read UDF filesystem on ISO: %w", err)
 	}
-	//totalSize := GetISOContentSize(iso)
+	var isoHasher *BackgroundHash
+	if *hashISOFlag || *reportFlag != "" {
+		isoHasher = HashFileInBackground(ctx, file) // Recorded in the manifest after extraction
+	}
+	var overlay Overlay
+	if len(overlayFlag) > 0 {
+		overlay, err = LoadOverlay(overlayFlag)
+		if err != nil {
+			return logError("failed to load overlay: %w", err)
+		}
+		var conflicts []string
+		overlay, conflicts, err = ResolveOverlayConflicts(iso, overlay)
+		if err != nil {
+			return logError("cannot apply overlay: %w", err)
+		} else if len(conflicts) > 0 {
+			logWarn("Warning: The following files in the ISO will be replaced by files from the overlay:\n%s",
+				strings.Join(conflicts, "\n"))
+		}
+	}
+	contents := AnalyzeContents(iso, exclude, overlay)
+	var windowsBuild *WindowsBuild
+	if *reportFlag != "" {
+		if windowsBuild, err = DetectWindowsBuild(iso); err != nil {
+			logWarn("Warning: Failed to detect Windows build, it will not be recorded in the report: %v", err)
+		}
+	}
+	if len(exclude) > 0 {
+		excludedSize := GetISOContentSize(iso, nil) - GetISOContentSize(iso, exclude)
+		log.Println("Excluded files:", imaging.BytesToString(int(excludedSize), true), "will not be written",
+			"("+imaging.BytesToString(int(contents.TotalSize), true), "to write in total)")
+	}
+	//totalSize := GetISOContentSize(iso, exclude)
 	//log.Println("Total ISO size:", strconv.Itoa(int(totalSize)), "bytes",
 	//	"("+imaging.BytesToString(int(totalSize), false)+", "+imaging.BytesToString(int(totalSize), true)+")")
-	if ctx.Err() != nil {
-		return logError("operation cancelled")
-	}
 
-	// Step 2: Open the block device and create a new partition table
+	errorCode = ErrorCodeInvalidDevice
 	blockDevice := args[1]
-	currentPhase++
-	logProgress("Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Partitioning destination drive")
 	destStat, err := os.Stat(blockDevice)
 	if err != nil {
 		return logError("failed to get info about destination: %w", err)
@@ -410,17 +592,156 @@ The following device will be converted into a Windows installation USB drive:
 			return logError("destination %s is not a valid block device!", blockDevice)
 		}
 	}
-	blockDeviceSize, err := GetBlockDeviceSize(blockDevice)
-	const deviceSizeMargin = 4 * 1024 * 1024 // Extra 4 MB margin for partition table, UEFI:NTFS, etc
+	singlePartitionSize, err := GetPrimaryPartitionCapacity(blockDevice, gptFlag != nil && *gptFlag, true,
+		dataPartitionSize(dataPartition))
 	if err != nil {
 		return logError("failed to get size of destination: %w", err)
-	} else if srcStat.Size()+deviceSizeMargin > blockDeviceSize {
-		if !debugBypassChecks {
-			return logError("cannot write ISO to destination: ISO size (%s) is larger than device size (%s)!",
-				imaging.BytesToString(int(srcStat.Size()), true),
-				imaging.BytesToString(int(blockDeviceSize), true))
+	}
+	partitionSize, err := GetPrimaryPartitionCapacity(blockDevice, gptFlag != nil && *gptFlag, false,
+		dataPartitionSize(dataPartition))
+	if err != nil {
+		return logError("failed to get size of destination: %w", err)
+	} else if debugBypassChecks {
+		singlePartitionSize, partitionSize = math.MaxInt64, math.MaxInt64
+	}
+	if gptFlag == nil || !*gptFlag {
+		if usable, total, err := GetMBRUsableSize(blockDevice); err == nil && usable < total {
+			logWarn("Warning: MBR partitions can only address the first %s of this %s drive, so the remaining %s "+
+				"will be left unused. Pass -gpt to use the whole drive, if it will only be booted on UEFI PCs.",
+				imaging.BytesToString(int(usable), true), imaging.BytesToString(int(total), true),
+				imaging.BytesToString(int(total-usable), true))
 		}
 	}
+	if *fsFlag == "auto" {
+		filesystem, reason := contents.ChooseFilesystem(
+			supportedFilesystems, singlePartitionSize, partitionSize, gptFlag != nil && *gptFlag)
+		*fsFlag = filesystem
+		if filesystem == "exfat" {
+			logWarn("Warning: Automatically selected exFAT, as %s. %s", reason, addendum)
+		} else {
+			logNotice("Automatically selected %s, as %s.", getFilesystemName(filesystem), reason)
+		}
+	}
+	if *fsFlag == "fat32" {
+		partitionSize = singlePartitionSize
+	}
+	if dataPartition != nil && dataPartition.Size == 0 {
+		// Sized from the real capacity of the drive, even if checks are bypassed
+		capacity, err := GetPrimaryPartitionCapacity(blockDevice, gptFlag != nil && *gptFlag, *fsFlag == "fat32", 0)
+		if err != nil {
+			return logError("failed to get size of destination: %w", err)
+		} else if dataPartition.Size, err = contents.SizeDataPartition(*fsFlag, capacity); err != nil {
+			return logError("%w", err)
+		}
+		sourcesSize, err := GetPrimaryPartitionCapacity(blockDevice, gptFlag != nil && *gptFlag, *fsFlag == "fat32",
+			dataPartition.Size)
+		if err != nil {
+			return logError("failed to get size of destination: %w", err)
+		} else if !debugBypassChecks {
+			partitionSize = sourcesSize
+		}
+		logNotice("Using %s for the sources partition and %s for the data partition.",
+			imaging.BytesToString(int(sourcesSize), true), imaging.BytesToString(int(dataPartition.Size), true))
+	}
+	// Check the ISO contents against the partition and filesystem they will be written to
+	errorCode = ErrorCodeIncompatible
+	if problems := contents.CheckCompatibility(*fsFlag, partitionSize); len(problems) > 0 {
+		return logError("cannot write ISO to destination with %s:\n%s",
+			getFilesystemName(*fsFlag), FormatCompatibilityProblems(problems))
+	}
+	if ctx.Err() != nil {
+		return logError("operation cancelled")
+	}
+
+	// Weigh each phase by roughly how long it takes, in terms of bytes written to the drive
+	extractionSize := GetISOContentSize(iso, exclude) + overlay.Size()
+	phaseWeights := []int64{16 * 1024 * 1024} // Partitioning
+	if *fsFlag != "fat32" {
+		phaseWeights = append(phaseWeights, 1024*1024) // UEFI:NTFS writing
+	}
+	phaseWeights = append(phaseWeights, 64*1024*1024, extractionSize) // Formatting and extraction
+	if !*skipValidationFlag {
+		// USB drives typically read at least twice as fast as they write
+		phaseWeights = append(phaseWeights, max(contents.ValidationReadSize(validationMode)/2, 1024*1024))
+	}
+	if !*gptFlag {
+		phaseWeights = append(phaseWeights, 1024*1024) // MBR writing
+	}
+	phaseProgress := NewPhaseProgress(phaseWeights)
+	totalPhases := strconv.Itoa(len(phaseWeights))
+	currentPhase := 0
+	updateProgressBar := func(fraction float64) {
+		percentage := phaseProgress.Percentage(currentPhase, fraction)
+		renderer.SetOverall(percentage)
+		events.SetOverall(percentage)
+		if dlg != nil {
+			dlg.Value(percentage)
+		}
+	}
+	currentPhaseID := ""
+	startPhase := func(id, name string) string {
+		currentPhase++
+		currentPhaseID = id
+		events.StartPhase(currentPhase, len(phaseWeights), id, name)
+		updateProgressBar(0)
+		message := "Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": " + name
+		logProgress(message)
+		return message
+	}
+	errorCode = "" // Errors from here on are reported as failures of the current phase
+
+	// Record every flash in the history ledger, whether it succeeds or not
+	deviceModel, deviceSerial, err := GetDeviceIdentity(blockDevice)
+	if err != nil {
+		logWarn("Warning: Failed to identify destination drive, its model and serial will not be recorded: %v", err)
+	}
+	isoPath, err := filepath.Abs(args[0])
+	if err != nil {
+		isoPath = args[0]
+	}
+	flashStarted := time.Now()
+	recordHistory = func(err error) {
+		recordHistory = func(err error) {} // Only record the first outcome
+		entry := HistoryEntry{
+			Time:       flashStarted.UTC(),
+			Command:    "flash",
+			Operator:   GetOperator(),
+			Version:    version,
+			ISOPath:    isoPath,
+			ISOLabel:   iso.GetLogicalVolumeIdentifier(),
+			Device:     blockDevice,
+			Model:      deviceModel,
+			Serial:     deviceSerial,
+			Outcome:    HistoryOutcomeSuccess,
+			DurationMs: time.Since(flashStarted).Milliseconds(),
+		}
+		if wizard {
+			entry.Command = "wizard"
+		}
+		if ctx.Err() != nil {
+			entry.Outcome, entry.ErrorCode = HistoryOutcomeCancelled, ErrorCodeCancelled
+		} else if err != nil {
+			entry.Outcome, entry.ErrorCode = HistoryOutcomeFailed, errorCode
+			if entry.ErrorCode == "" {
+				entry.ErrorCode = currentPhaseID + "_failed"
+			}
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		// Don't hold up reporting a failure until the whole ISO has been read
+		entry.ISOSHA256 = hex.EncodeToString(isoHasher.Finished())
+		if err := AppendHistory(GetHistoryFile(), entry); err != nil {
+			log.Printf("Warning: Failed to record flash in history: %v", err)
+		}
+	}
+
+	// Step 1: Create a new partition table on the block device
+	if *resumeFlag {
+		startPhase("partitioning", "Checking partitions on destination drive")
+	} else {
+		startPhase("partitioning", "Partitioning destination drive")
+	}
 	err = imaging.UnmountDevice(blockDevice)
 	if err != nil && err != imaging.ErrNotBlockDevice { // Ignore non-block-device error here
 		return logError("failed to unmount destination device: %w", err)
@@ -428,22 +749,30 @@ The following device will be converted into a Windows installation USB drive:
 	if ctx.Err() != nil {
 		return logError("operation cancelled")
 	}
-	if *fsFlag == "fat32" {
-		err = FormatDiskForSinglePartition(blockDevice, gptFlag != nil && *gptFlag)
+	if *resumeFlag {
+		err = CheckDiskLayout(blockDevice, gptFlag != nil && *gptFlag, *fsFlag == "fat32", dataPartition != nil)
+		if err != nil {
+			return logError("cannot resume flash, destination was not partitioned by glassUSB with these options: %w", err)
+		}
+	} else if *fsFlag == "fat32" {
+		err = FormatDiskForSinglePartition(blockDevice, gptFlag != nil && *gptFlag, dataPartition)
 	} else {
-		err = FormatDiskForUEFINTFS(blockDevice, gptFlag != nil && *gptFlag)
+		err = FormatDiskForUEFINTFS(blockDevice, gptFlag != nil && *gptFlag, dataPartition)
 	}
 	if err != nil {
 		return logError("failed to format disk: %w", err)
 	}
+	primaryPartition, err := GetBlockDevicePartition(blockDevice, 1)
+	if err != nil {
+		return logError("failed to find sources partition: %w", err)
+	}
 	if ctx.Err() != nil {
 		return logError("operation cancelled")
 	}
 
-	// Step 3: Write UEFI:NTFS to second partition
+	// Step 2: Write UEFI:NTFS to second partition
 	if *fsFlag != "fat32" {
-		currentPhase++
-		logProgress("Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Writing UEFI:NTFS bootloader")
+		startPhase("uefi_ntfs", "Writing UEFI:NTFS bootloader")
 		err = WriteUEFINTFSToPartition(blockDevice, 2)
 		if err != nil {
 			return logError("failed to write UEFI bootloader to second partition: %w", err)
@@ -453,44 +782,55 @@ The following device will be converted into a Windows installation USB drive:
 		}
 	}
 
-	// Step 4: Format primary partition depending on fs flag
-	currentPhase++
-	logProgress("Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Creating sources partition")
-	primaryPartition := GetBlockDevicePartition(blockDevice, 1)
+	// Step 3: Format primary partition depending on fs flag
+	if *resumeFlag {
+		startPhase("formatting", "Reusing existing sources partition")
+	} else {
+		startPhase("formatting", "Creating sources partition")
+	}
 	windowsVolumeLabel := iso.GetLogicalVolumeIdentifier()
 	if windowsVolumeLabel == "" {
 		windowsVolumeLabel = "Windows USB"
 	}
-	switch *fsFlag {
-	case "exfat":
+	switch {
+	case *resumeFlag:
+		// The filesystem was already created by the interrupted flash
+	case *fsFlag == "exfat":
 		if err := MakeExFAT(primaryPartition, sanitizeExFATLabel(windowsVolumeLabel)); err != nil {
 			return logError("failed to create exFAT filesystem: %w", err)
 		}
-	case "ntfs":
+	case *fsFlag == "ntfs":
 		if err := MakeNTFS(primaryPartition, sanitizeNTFSLabel(windowsVolumeLabel)); err != nil {
 			return logError("failed to create NTFS filesystem: %w", err)
 		}
-	case "fat32":
+	case *fsFlag == "fat32":
 		if err := MakeFAT32(primaryPartition, sanitizeFATLabel(windowsVolumeLabel)); err != nil {
 			return logError("failed to create FAT32 filesystem: %w", err)
 		}
 	}
+	if dataPartition != nil && !*resumeFlag {
+		if err := FormatDataPartition(blockDevice, *fsFlag == "fat32", dataPartition); err != nil {
+			return logError("failed to create data partition: %w", err)
+		}
+	}
 	if ctx.Err() != nil {
 		return logError("operation cancelled")
 	}
 
-	// Step 5: Unpack Windows ISO contents to primary partition
-	if err = func() error {
-		currentPhase++
-		progStr := "Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Extracting ISO to sources partition"
-		logProgress(progStr)
+	// Step 4: Unpack Windows ISO contents to primary partition
+	var hashes FileHashes
+	var isoHash []byte
+	phaseStr := startPhase("extraction", "Extracting ISO to sources partition")
+	resumeExtraction := *resumeFlag
+	extract := func() error {
+		progStr := phaseStr
 		mountPoint, err := os.MkdirTemp(os.TempDir(), "glassusb-")
 		if err != nil {
-			return logError("failed to create mount point: %w", err)
+			return fmt.Errorf("failed to create mount point: %w", err)
 		}
 		defer os.Remove(mountPoint)
 		if err := MountPartition(primaryPartition, mountPoint); err != nil {
-			return logError("failed to mount partition: %w", err)
+			return fmt.Errorf("failed to mount partition: %w", err)
 		}
 		defer func() {
 			if err := UnmountPartition(mountPoint); err != nil {
@@ -498,10 +838,13 @@ The following device will be converted into a Windows installation USB drive:
 			}
 		}()
 		if ctx.Err() != nil {
-			return logError("operation cancelled")
+			return fmt.Errorf("operation cancelled")
 		}
-		logFn := func(log string) {
-			print(log)
+		var progressOffset int64 // Bytes extracted before copying overlay files
+		logFn := func(update ProgressUpdate) {
+			renderer.Update(update)
+			events.Progress(update)
+			updateProgressBar(float64(progressOffset+update.Done) / float64(max(extractionSize, 1)))
 			if dlg != nil {
 				separator := "\n"
 				if runtime.GOOS == "linux" {
@@ -509,25 +852,119 @@ The following device will be converted into a Windows installation USB drive:
 					// Meanwhile, macOS doesn't even show newlines lol
 					separator = "\\n"
 				}
-				dlg.Text(progStr + separator + strings.TrimSpace(log))
+				dlg.Text(progStr + separator + update.String())
 			}
 		}
-		if err := ExtractISOToLocation(ctx, logFn, iso, mountPoint); err != nil {
-			return logError("failed to extract ISO contents: %w", err)
+		journalHeader := FlashJournalHeader{
+			ISOSize:        srcStat.Size(),
+			ISOLabel:       iso.GetLogicalVolumeIdentifier(),
+			ISOFingerprint: isoFingerprint,
+			Filesystem:     *fsFlag,
+			GPT:            gptFlag != nil && *gptFlag,
+			Exclude:        strings.Join(exclude, "\n"),
+			Overlay:        GetOverlayFingerprint(overlay),
+			DataPartition:  *dataPartitionFlag,
+		}
+		var journal *FlashJournal
+		if resumeExtraction {
+			journal, err = OpenFlashJournal(mountPoint, journalHeader)
+		} else {
+			journal, err = CreateFlashJournal(mountPoint, journalHeader)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open flash journal: %w", err)
+		}
+		defer journal.Close()
+		hashes, err = ExtractISOToLocation(ctx, logFn, iso, mountPoint, exclude, journal)
+		if err != nil {
+			return fmt.Errorf("failed to extract ISO contents: %w", err)
+		}
+		if len(overlay) > 0 {
+			progressOffset = extractionSize - overlay.Size()
+			progStr = "Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Copying overlay files to sources partition"
+			logProgress(progStr)
+			if err := CopyOverlayToLocation(ctx, logFn, overlay, mountPoint, hashes); err != nil {
+				return fmt.Errorf("failed to copy overlay: %w", err)
+			}
+		}
+		isoHash, err = isoHasher.Wait()
+		if err != nil && ctx.Err() == nil {
+			logWarn("Warning: Failed to hash ISO, its hash will not be recorded in the manifest: %v", err)
+		}
+		manifest, err := NewManifest(contents, hashes, ManifestISO{
+			Name:   filepath.Base(args[0]),
+			Size:   srcStat.Size(),
+			Label:  iso.GetLogicalVolumeIdentifier(),
+			SHA256: hex.EncodeToString(isoHash),
+		}, NewManifestLayout(gptFlag != nil && *gptFlag, *fsFlag == "fat32", dataPartition != nil, *fsFlag))
+		if err != nil {
+			return fmt.Errorf("failed to create manifest: %w", err)
+		}
+		manifest.Exclude, manifest.Overlay = exclude, len(overlay) > 0
+		if err := WriteManifest(mountPoint, manifest); err != nil {
+			return err
+		}
+		if *skipValidationFlag {
+			journal.Close()
+			if err := RemoveFlashJournal(mountPoint); err != nil {
+				return fmt.Errorf("failed to remove flash journal: %w", err)
+			}
 		}
 		return nil
-	}(); err != nil {
-		return err
+	}
+	for {
+		err = extract()
+		var ioErr *FileIOError
+		retryable := err != nil && ctx.Err() == nil &&
+			(IsDeviceGone(err, blockDevice) || (errors.As(err, &ioErr) && isTransientIOError(err)))
+		if !retryable {
+			break
+		} else if !wizard {
+			return logError("%w\nIf the drive was disconnected, reconnect it and run glassUSB again with -resume "+
+				"to continue where the flash stopped.", err)
+		}
+		extractErr := err
+		err = zenity.Question("Writing to the USB drive failed:\n\n"+imaging.CapitalizeString(err.Error())+
+			"\n\nIf the drive was disconnected, reconnect it to the same port, and press 'Reconnect and retry' to "+
+			"continue where the flash stopped.",
+			zenity.Width(640),
+			zenity.WindowIcon(zenity.WarningIcon),
+			zenity.Title("glassUSB Media Creation Wizard"),
+			zenity.Icon(zenity.WarningIcon),
+			zenity.CancelLabel("Exit"),
+			zenity.OKLabel("Reconnect and retry"))
+		if err != nil {
+			recordHistory(extractErr)
+			return fmt.Errorf("failed to continue with wizard: %w", err)
+		}
+		logProgress("Waiting for the USB drive to be reconnected...")
+		if err := WaitForDevice(ctx, primaryPartition, deviceReconnectTimeout); err != nil {
+			return logError("failed to find USB drive after reconnecting: %w", err)
+		}
+		events.Warning("Retrying extraction after an I/O error")
+		logProgress(phaseStr)
+		resumeExtraction = true
+	}
+	if err != nil {
+		return logError("%w", err)
 	}
 
-	// Step 6: Validate Windows ISO contents on primary partition
+	// Step 5: Validate Windows ISO contents on primary partition
+	validation := ReportValidation{Mode: string(validationMode), Details: "Validation was skipped"}
+	if compareWithISO {
+		validation.Mode = "compare"
+	}
 	if err = func() error {
 		if *skipValidationFlag {
 			return nil
 		}
-		currentPhase++
-		progStr := "Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Validating ISO contents on sources partition"
-		logProgress(progStr)
+		progStr := startPhase("validation", "Validating ISO contents on sources partition")
+		// Make sure written data is read back from the USB drive, and not from memory
+		cacheFlushed := true
+		if err := FlushBlockDeviceCache(primaryPartition); err != nil {
+			log.Printf("Failed to flush cache for %s, validation may read from memory: %v", primaryPartition, err)
+			cacheFlushed = false
+		}
 		mountPoint, err := os.MkdirTemp(os.TempDir(), "glassusb-")
 		if err != nil {
 			return logError("failed to create mount point: %w", err)
@@ -544,8 +981,12 @@ The following device will be converted into a Windows installation USB drive:
 		if ctx.Err() != nil {
 			return logError("operation cancelled")
 		}
-		logFn := func(log string) {
-			print(log)
+		logFn := func(update ProgressUpdate) {
+			renderer.Update(update)
+			events.Progress(update)
+			if update.Total > 0 {
+				updateProgressBar(float64(update.Done) / float64(update.Total))
+			}
 			if dlg != nil {
 				separator := "\n"
 				if runtime.GOOS == "linux" {
@@ -553,21 +994,35 @@ The following device will be converted into a Windows installation USB drive:
 					// Meanwhile, macOS doesn't even show newlines lol
 					separator = "\\n"
 				}
-				dlg.Text(progStr + separator + strings.TrimSpace(log))
+				dlg.Text(progStr + separator + update.String())
 			}
 		}
-		if err := ValidateISOAgainstLocation(ctx, logFn, iso, mountPoint); err != nil {
+		if compareWithISO {
+			hashes = nil // Compare against the ISO itself instead of the hashes
+		}
+		guarantee, err := ValidateISOAgainstLocation(ctx, logFn, iso, mountPoint, exclude, validationMode, hashes, overlay)
+		if err != nil {
 			return logError("failed to validate ISO contents: %w", err)
 		}
+		if err := RemoveFlashJournal(mountPoint); err != nil {
+			return logError("failed to remove flash journal: %w", err)
+		}
+		if !cacheFlushed {
+			guarantee = ReadGuaranteeNone
+		}
+		validation.Passed, validation.Details = true, guarantee.String()
+		if validationMode == ValidationSize {
+			validation.Details = "all files exist with the expected sizes, their contents were not read"
+		}
+		log.Println("Validation succeeded: " + validation.Details)
 		return nil
 	}(); err != nil {
 		return err
 	}
 
-	// Step 7: Write MBR to device for boot using `ms-sys`
+	// Step 6: Write MBR to device for boot using `ms-sys`
 	if gptFlag == nil || !*gptFlag {
-		currentPhase++
-		logProgress("Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": Writing MBR bootloader")
+		startPhase("mbr", "Writing MBR bootloader")
 		if err := WriteVBRToPartition(primaryPartition); err != nil {
 			return logError("failed to write VBR bootloader: %w", err)
 		}
@@ -577,8 +1032,35 @@ The following device will be converted into a Windows installation USB drive:
 	}
 	signal.Reset(os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
+	// Write a report of the flash if requested
+	if *reportFlag != "" {
+		events.EndPhase()
+		errorCode = ErrorCodeReport
+		report := &FlashReport{
+			CompletedAt: time.Now().UTC(),
+			ISO: ReportISO{
+				Path:         isoPath,
+				Size:         srcStat.Size(),
+				SHA256:       hex.EncodeToString(isoHash),
+				Label:        iso.GetLogicalVolumeIdentifier(),
+				WindowsBuild: windowsBuild,
+			},
+			Device:     ReportDevice{Path: blockDevice, Model: deviceModel, Serial: deviceSerial},
+			Layout:     NewManifestLayout(gptFlag != nil && *gptFlag, *fsFlag == "fat32", dataPartition != nil, *fsFlag),
+			Label:      sanitizeLabel(*fsFlag, windowsVolumeLabel),
+			Phases:     events.Timings(),
+			Validation: validation,
+		}
+		if err := WriteReport(*reportFlag, report, reportKey); err != nil {
+			return logError("%w", err)
+		}
+		log.Println("Wrote flash report to", *reportFlag)
+	}
+
 	// If dialog, complete it
 	logProgress("The flash process completed successfully! You can now boot from this USB to install Windows.")
+	recordHistory(nil)
+	events.Result(nil, "")
 	if dlg != nil {
 		err = dlg.Complete()
 		if err != nil {
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// manifestFileName is the name of the manifest written to the root of the primary partition.
+const manifestFileName = "glassusb.json"
+
+// manifestVersion is incremented whenever fields are removed from the manifest or change meaning.
+const manifestVersion = 1
+
+var ErrNoManifest = errors.New("no glassUSB manifest found on this drive")
+
+// Manifest records what was written to a drive, so that it can be verified without the ISO.
+type Manifest struct {
+	Version         int            `json:"version"`
+	GlassUSBVersion string         `json:"glassusbVersion"`
+	CreatedAt       time.Time      `json:"createdAt"`
+	ISO             ManifestISO    `json:"iso"`
+	Layout          ManifestLayout `json:"layout"`
+	Exclude         []string       `json:"exclude,omitempty"`
+	Overlay         bool           `json:"overlay,omitempty"`
+	Files           []ManifestFile `json:"files"`
+	// Checksum is the SHA-256 hash of the manifest with this field empty, to detect corruption. It
+	// is not keyed, so it does not protect against deliberate modification.
+	Checksum string `json:"checksum"`
+}
+
+type ManifestISO struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Label  string `json:"label"`
+	SHA256 string `json:"sha256,omitempty"` // Omitted unless the ISO was hashed with -hash-iso
+}
+
+type ManifestLayout struct {
+	PartitionTable  string `json:"partitionTable"` // "mbr" or "gpt"
+	SinglePartition bool   `json:"singlePartition"`
+	DataPartition   bool   `json:"dataPartition,omitempty"`
+	Filesystem      string `json:"filesystem"`
+}
+
+// NewManifestLayout describes the layout of a drive flashed with the given options.
+func NewManifestLayout(useGpt bool, singlePartition bool, dataPartition bool, filesystem string) ManifestLayout {
+	layout := ManifestLayout{PartitionTable: "mbr", SinglePartition: singlePartition, DataPartition: dataPartition,
+		Filesystem: filesystem}
+	if useGpt {
+		layout.PartitionTable = "gpt"
+	}
+	return layout
+}
+
+// ManifestFile is a file or folder on the primary partition, with its slash-separated path.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	IsDir  bool   `json:"isDir,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// NewManifest creates a manifest of the given contents, using the hashes computed while writing
+// them to the drive.
+func NewManifest(contents *ContentAnalysis, hashes FileHashes, iso ManifestISO, layout ManifestLayout) (*Manifest, error) {
+	manifest := &Manifest{
+		Version:         manifestVersion,
+		GlassUSBVersion: version,
+		CreatedAt:       time.Now().UTC(),
+		ISO:             iso,
+		Layout:          layout,
+		Files:           make([]ManifestFile, 0, len(contents.Entries)),
+	}
+	for _, entry := range contents.Entries {
+		file := ManifestFile{Path: entry.Path, IsDir: entry.IsDir}
+		if !entry.IsDir {
+			hash, ok := hashes[entry.Path]
+			if !ok {
+				return nil, fmt.Errorf("no hash was recorded for file %s", entry.Path)
+			}
+			file.Size, file.SHA256 = entry.Size, hex.EncodeToString(hash)
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	return manifest, nil
+}
+
+func (m *Manifest) computeChecksum() (string, error) {
+	unchecked := *m
+	unchecked.Checksum = ""
+	data, err := json.Marshal(unchecked)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// WriteManifest sets the checksum of the manifest, and writes it to the root of the location.
+func WriteManifest(location string, manifest *Manifest) error {
+	checksum, err := manifest.computeChecksum()
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	manifest.Checksum = checksum
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	file, err := os.Create(filepath.Join(location, manifestFileName))
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	} else if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest at the root of the location, checking that it is not corrupt.
+func ReadManifest(location string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(location, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoManifest
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	} else if manifest.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest version %d is not supported by this version of glassUSB, try updating it",
+			manifest.Version)
+	}
+	if checksum, err := manifest.computeChecksum(); err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	} else if checksum != manifest.Checksum {
+		return nil, fmt.Errorf("manifest checksum does not match its contents, it may be corrupt")
+	}
+	return &manifest, nil
+}
+
+// ValidateManifestAgainstLocation checks that the files at the location match the hashes in the
+// manifest, and that there are no extra files outside the root of the location. Files are read
+// while avoiding the page cache where possible, and the weakest guarantee achieved is returned.
+func ValidateManifestAgainstLocation(ctx context.Context, logFn ProgressFunc, manifest *Manifest, location string) (ReadGuarantee, error) {
+	progress := &Progress{}
+	progressCtx, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	var total int64
+	for _, file := range manifest.Files {
+		total += file.Size
+	}
+	go logProgressPerSecond(progressCtx, logFn, "validated", progress, total)
+
+	guarantee := ReadGuaranteeDirect
+	known := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		known[strings.ToLower(file.Path)] = true
+		if ctx.Err() != nil {
+			return guarantee, fmt.Errorf("operation cancelled")
+		}
+		name := filepath.Join(location, filepath.FromSlash(file.Path))
+		if file.IsDir {
+			if stat, err := os.Stat(name); err != nil {
+				return guarantee, fmt.Errorf("failed to stat directory %s: %w", file.Path, err)
+			} else if !stat.IsDir() {
+				return guarantee, fmt.Errorf("%s is not a directory", file.Path)
+			}
+			continue
+		}
+		expectedHash, err := hex.DecodeString(file.SHA256)
+		if err != nil {
+			return guarantee, fmt.Errorf("invalid hash recorded for file %s: %w", file.Path, err)
+		}
+		progress.StartFile(file.Path, file.Size)
+		if err := validateFileHash(ctx, name, file.Size, expectedHash, progress, &guarantee); err != nil {
+			return guarantee, err
+		}
+	}
+
+	// As with ISO validation, the root is skipped since OSes create garbage there
+	err := filepath.WalkDir(location, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(location, name)
+		if err != nil || relPath == "." {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if path.Dir(relPath) == "." {
+			if slices.Contains(ignoredRootEntries, entry.Name()) || !known[strings.ToLower(relPath)] {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		} else if !known[strings.ToLower(relPath)] {
+			return fmt.Errorf("extra file %s found that is not in the manifest", relPath)
+		}
+		return nil
+	})
+	return guarantee, err
+}
+
+// BackgroundHash is the SHA-256 hash of a file which is being computed in the background. A nil
+// BackgroundHash stands for a file which isn't being hashed, and has no hash.
+type BackgroundHash struct {
+	done chan struct{}
+	sum  []byte
+	err  error
+}
+
+// HashFileInBackground starts computing the SHA-256 hash of a file.
+func HashFileInBackground(ctx context.Context, file *os.File) *BackgroundHash {
+	h := &BackgroundHash{done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		stat, err := file.Stat()
+		if err != nil {
+			h.err = err
+			return
+		}
+		hash := sha256.New()
+		// Read with ReadAt, so that the file can be read concurrently elsewhere
+		reader := io.NewSectionReader(file, 0, stat.Size())
+		buf := make([]byte, 4*1024*1024)
+		for {
+			if ctx.Err() != nil {
+				h.err = fmt.Errorf("operation cancelled")
+				return
+			}
+			n, err := reader.Read(buf)
+			hash.Write(buf[:n])
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				h.err = err
+				return
+			}
+		}
+		h.sum = hash.Sum(nil)
+	}()
+	return h
+}
+
+// Wait waits for the hash to be computed, and returns it.
+func (h *BackgroundHash) Wait() ([]byte, error) {
+	if h == nil {
+		return nil, nil
+	}
+	<-h.done
+	return h.sum, h.err
+}
+
+// Finished returns the hash if it has already been computed, without waiting for it.
+func (h *BackgroundHash) Finished() []byte {
+	if h == nil {
+		return nil
+	}
+	select {
+	case <-h.done:
+		return h.sum
+	default:
+		return nil
+	}
+}
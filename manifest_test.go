@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	location := t.TempDir()
+	files := map[string]string{"setup.exe": "setup", "sources/boot.wim": "boot", "sources/install.wim": "install"}
+	hashes := FileHashes{}
+	contents := &ContentAnalysis{Entries: []ContentEntry{{Path: "sources", IsDir: true}}}
+	for name, data := range files {
+		os.MkdirAll(filepath.Join(location, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(location, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(data))
+		hashes[name] = sum[:]
+		contents.Entries = append(contents.Entries, ContentEntry{Path: name, Size: int64(len(data))})
+	}
+	manifest, err := NewManifest(contents, hashes, ManifestISO{Name: "windows.iso"}, NewManifestLayout(true, false, false, "ntfs"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := WriteManifest(location, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err = ReadManifest(location)
+	if err != nil {
+		t.Fatalf("failed to read manifest back: %v", err)
+	} else if manifest.Layout.PartitionTable != "gpt" || len(manifest.Files) != 4 {
+		t.Errorf("manifest did not round trip, got %+v", manifest)
+	}
+	noop := func(ProgressUpdate) {}
+	if _, err := ValidateManifestAgainstLocation(context.Background(), noop, manifest, location); err != nil {
+		t.Errorf("expected unmodified files to validate, got %v", err)
+	}
+
+	// Extra files are only allowed at the root
+	os.WriteFile(filepath.Join(location, "autorun.inf"), []byte("extra"), 0644)
+	if _, err := ValidateManifestAgainstLocation(context.Background(), noop, manifest, location); err != nil {
+		t.Errorf("expected extra file at root to be ignored, got %v", err)
+	}
+	os.MkdirAll(filepath.Join(location, ".Trash-1000", "files"), 0755)
+	os.WriteFile(filepath.Join(location, ".Trash-1000", "files", "install.wim"), []byte("extra"), 0644)
+	if _, err := ValidateManifestAgainstLocation(context.Background(), noop, manifest, location); err != nil {
+		t.Errorf("expected extra folder at root to be ignored, got %v", err)
+	}
+	os.WriteFile(filepath.Join(location, "sources", "extra.wim"), []byte("extra"), 0644)
+	if _, err := ValidateManifestAgainstLocation(context.Background(), noop, manifest, location); err == nil ||
+		!strings.Contains(err.Error(), "extra file") {
+		t.Errorf("expected extra file in sources to fail validation, got %v", err)
+	}
+	os.Remove(filepath.Join(location, "sources", "extra.wim"))
+	os.WriteFile(filepath.Join(location, "sources", "boot.wim"), []byte("tool"), 0644)
+	if _, err := ValidateManifestAgainstLocation(context.Background(), noop, manifest, location); err == nil {
+		t.Error("expected modified file to fail validation")
+	}
+
+	// Modifying the manifest itself must be detected
+	data, _ := os.ReadFile(filepath.Join(location, manifestFileName))
+	data = []byte(strings.Replace(string(data), "windows.iso", "windowz.iso", 1))
+	os.WriteFile(filepath.Join(location, manifestFileName), data, 0644)
+	if _, err := ReadManifest(location); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected modified manifest to fail checksum, got %v", err)
+	}
+	os.Remove(filepath.Join(location, manifestFileName))
+	if _, err := ReadManifest(location); err != ErrNoManifest {
+		t.Errorf("expected ErrNoManifest for missing manifest, got %v", err)
+	}
+}
+
+func TestHashFileInBackground(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "windows.iso")
+	data := []byte(strings.Repeat("glassUSB", 1024*1024))
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	hasher := HashFileInBackground(context.Background(), file)
+	sum, err := hasher.Wait()
+	if expected := sha256.Sum256(data); err != nil || string(sum) != string(expected[:]) {
+		t.Errorf("expected hash %x, got %x (error %v)", expected, sum, err)
+	} else if finished := hasher.Finished(); string(finished) != string(sum) {
+		t.Errorf("expected the finished hash to be available without waiting, got %x", finished)
+	}
+	var unhashed *BackgroundHash
+	if sum, err := unhashed.Wait(); sum != nil || err != nil || unhashed.Finished() != nil {
+		t.Errorf("expected no hash for a file which isn't being hashed, got %x (error %v)", sum, err)
+	}
+}
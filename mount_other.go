@@ -10,6 +10,10 @@ func MountPartition(partition string, mountPoint string) error {
 	return errors.ErrUnsupported
 }
 
+func MountPartitionReadOnly(partition string, mountPoint string) error {
+	return errors.ErrUnsupported
+}
+
 func UnmountPartition(mountPoint string) error {
 	return errors.ErrUnsupported
 }
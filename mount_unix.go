@@ -18,6 +18,14 @@ func MountPartition(partition string, mountPoint string) error {
 	return nil
 }
 
+// MountPartitionReadOnly mounts a partition without allowing any writes to it.
+func MountPartitionReadOnly(partition string, mountPoint string) error {
+	if out, err := exec.Command("mount", "-r", partition, mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount partition: %w\noutput: %s", err, out)
+	}
+	return nil
+}
+
 func UnmountPartition(mountPoint string) error {
 	if err := syscall.Unmount(mountPoint, 0); err != nil {
 		return fmt.Errorf("failed to unmount partition: %w", err)
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/retrixe/udf"
+)
+
+// OverlayFile is a file or folder on this system which is copied onto the USB drive.
+type OverlayFile struct {
+	Source  string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// Overlay maps slash-separated paths relative to the root of the USB drive to the files and folders
+// copied there after the ISO is extracted. Overlay files take precedence over files in the ISO.
+type Overlay map[string]OverlayFile
+
+// LoadOverlay collects the contents of the given folders into an overlay. Later folders take
+// precedence over earlier ones if they contain the same file.
+func LoadOverlay(dirs []string) (Overlay, error) {
+	overlay := make(Overlay)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return err
+			} else if rel == "." {
+				if !d.IsDir() {
+					return fmt.Errorf("%s is not a folder", dir)
+				}
+				return nil
+			}
+			relPath := filepath.ToSlash(rel)
+			info, err := d.Info()
+			if err != nil {
+				return err
+			} else if !d.IsDir() && !info.Mode().IsRegular() {
+				return fmt.Errorf("%s is not a regular file or folder", name)
+			} else if existing, ok := overlay[relPath]; ok && existing.IsDir != d.IsDir() {
+				return fmt.Errorf("%s is a file in one overlay and a folder in another", relPath)
+			}
+			overlay[relPath] = OverlayFile{Source: name, IsDir: d.IsDir(), Size: info.Size(), ModTime: info.ModTime()}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read overlay %s: %w", dir, err)
+		}
+	}
+	return overlay, nil
+}
+
+// Size returns the total size of all files in the overlay.
+func (o Overlay) Size() int64 {
+	var size int64
+	for _, file := range o {
+		if !file.IsDir {
+			size += file.Size
+		}
+	}
+	return size
+}
+
+// Contains returns whether the overlay contains a file or folder at the given path.
+func (o Overlay) Contains(relPath string) bool {
+	_, ok := o[relPath]
+	return ok
+}
+
+// ResolveOverlayConflicts matches overlay paths against the ISO case-insensitively, since all
+// filesystems supported by glassUSB are case-insensitive, and adopts the casing used in the ISO.
+// It returns the paths of files in the ISO which will be replaced by overlay files, and an error
+// if an overlay file would replace a folder in the ISO or vice versa.
+func ResolveOverlayConflicts(iso *udf.Udf, overlay Overlay) (Overlay, []string, error) {
+	isoPaths := make(map[string]udf.File)
+	var walk func(files []udf.File, relPath string)
+	walk = func(files []udf.File, relPath string) {
+		for _, file := range files {
+			filePath := path.Join(relPath, file.Name())
+			isoPaths[strings.ToLower(filePath)] = file
+			if file.IsDir() {
+				walk(file.ReadDir(), filePath)
+			}
+		}
+	}
+	walk(iso.ReadDir(nil), "")
+
+	resolved := make(Overlay)
+	conflicts := []string{}
+	for relPath, file := range overlay {
+		resolvedPath := ""
+		var isoFile *udf.File
+		for component := range strings.SplitSeq(relPath, "/") {
+			resolvedPath = path.Join(resolvedPath, component)
+			isoFile = nil
+			if match, ok := isoPaths[strings.ToLower(resolvedPath)]; ok {
+				resolvedPath = path.Join(path.Dir(resolvedPath), match.Name())
+				isoFile = &match
+			}
+		}
+		if isoFile != nil && isoFile.IsDir() != file.IsDir {
+			if file.IsDir {
+				return nil, nil, fmt.Errorf("overlay folder %s conflicts with a file in the ISO", relPath)
+			}
+			return nil, nil, fmt.Errorf("overlay file %s conflicts with a folder in the ISO", relPath)
+		} else if isoFile != nil && !file.IsDir {
+			conflicts = append(conflicts, resolvedPath)
+		}
+		resolved[resolvedPath] = file
+	}
+	slices.Sort(conflicts)
+	return resolved, conflicts, nil
+}
+
+// CopyOverlayToLocation copies the overlay onto the given location, replacing any existing files,
+// and adds the SHA-256 hash of each copied file to hashes.
+func CopyOverlayToLocation(ctx context.Context, logFn ProgressFunc, overlay Overlay, location string, hashes FileHashes) error {
+	progress := &Progress{}
+	progressCtx, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	go logProgressPerSecond(progressCtx, logFn, "copied", progress, overlay.Size())
+
+	// Sorting ensures that folders are always created before their contents
+	paths := make([]string, 0, len(overlay))
+	for relPath := range overlay {
+		paths = append(paths, relPath)
+	}
+	slices.Sort(paths)
+	for _, relPath := range paths {
+		if ctx.Err() != nil {
+			return fmt.Errorf("operation cancelled")
+		}
+		file := overlay[relPath]
+		name := filepath.Join(location, filepath.FromSlash(relPath))
+		if file.IsDir {
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", name, err)
+			}
+			continue
+		}
+		progress.StartFile(relPath, file.Size)
+		hash, err := copyOverlayFile(ctx, file.Source, name, progress)
+		if ctx.Err() != nil {
+			return fmt.Errorf("operation cancelled")
+		} else if err != nil {
+			return fmt.Errorf("failed to copy overlay file %s: %w", relPath, err)
+		}
+		hashes[relPath] = hash
+	}
+	return nil
+}
+
+func copyOverlayFile(ctx context.Context, source string, name string, progress *Progress) ([]byte, error) {
+	srcFile, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+	stat, err := srcFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(name); err == nil {
+		_ = SetDOSAttributes(name, 0) // The ISO file being replaced may be read-only
+	}
+	newFile, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	defer newFile.Close()
+	hash, err := copyFileContents(ctx, io.NewSectionReader(srcFile, 0, stat.Size()), newFile, progress)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chtimes(name, stat.ModTime(), stat.ModTime()); err != nil {
+		return nil, fmt.Errorf("failed to set modification time: %w", err)
+	}
+	return hash, nil
+}
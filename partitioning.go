@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math"
+	"os"
 	"time"
 
 	"github.com/diskfs/go-diskfs"
@@ -10,11 +13,31 @@ import (
 	"github.com/diskfs/go-diskfs/partition"
 	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/retrixe/imprint/imaging"
 )
 
-// gptMetadataLBAs is the primary/backup GPT header (LBA 1) plus the default 128-entry
-// partition array (32 sectors at 512 bytes/sector).
-const gptMetadataLBAs = 33
+// gptEntryArraySize is the size in bytes of the default 128-entry GPT partition array, which spans
+// 32 sectors at 512 bytes/sector but only 4 sectors at 4096 bytes/sector.
+const gptEntryArraySize = 128 * 128
+
+// gptMetadataLBAs returns the number of logical blocks taken by the primary/backup GPT header
+// plus the partition entry array.
+func gptMetadataLBAs(logicalBlockSize int64) int64 {
+	return 1 + (gptEntryArraySize+logicalBlockSize-1)/logicalBlockSize
+}
+
+// mbrMaxLBAs is the number of logical blocks MBR partition entries can address with their 32-bit
+// LBAs, which is 2 TiB at 512 bytes/sector and 16 TiB at 4096 bytes/sector.
+const mbrMaxLBAs = math.MaxUint32
+
+// diskImageSectorSize is the logical sector size used for disk image files, which unlike block
+// devices have no sector size of their own. By default, go-diskfs uses 512 bytes.
+var diskImageSectorSize = diskfs.SectorSizeDefault
+
+// openDisk opens a block device or disk image with go-diskfs.
+func openDisk(name string, mode diskfs.OpenModeOption) (*disk.Disk, error) {
+	return diskfs.Open(name, diskfs.WithOpenMode(mode), diskfs.WithSectorSize(diskImageSectorSize))
+}
 
 // wipeStaleGPTMetadata removes leftover GPT headers and partition entry arrays so
 // go-diskfs reads the new MBR table. go-diskfs prefers GPT over MBR when opening
@@ -29,17 +52,18 @@ func wipeStaleGPTMetadata(d *disk.Disk) error {
 		return fmt.Errorf("invalid logical block size: %d", lss)
 	}
 	diskLBAs := d.Size / lss
-	if diskLBAs < gptMetadataLBAs*2+1 {
+	metadataLBAs := gptMetadataLBAs(lss)
+	if diskLBAs < metadataLBAs*2+1 {
 		return fmt.Errorf("disk is too small to wipe GPT metadata: %d logical blocks", diskLBAs)
 	}
 
 	zero := make([]byte, lss)
-	for lba := int64(1); lba <= gptMetadataLBAs; lba++ {
+	for lba := int64(1); lba <= metadataLBAs; lba++ {
 		if _, err := rw.WriteAt(zero, lba*lss); err != nil {
 			return fmt.Errorf("failed to wipe primary GPT metadata at LBA %d: %w", lba, err)
 		}
 	}
-	for i := int64(0); i < gptMetadataLBAs; i++ {
+	for i := int64(0); i < metadataLBAs; i++ {
 		lba := diskLBAs - 1 - i
 		if _, err := rw.WriteAt(zero, lba*lss); err != nil {
 			return fmt.Errorf("failed to wipe backup GPT metadata at LBA %d: %w", lba, err)
@@ -48,30 +72,196 @@ func wipeStaleGPTMetadata(d *disk.Disk) error {
 	return nil
 }
 
-// FormatDiskForSinglePartition formats a disk with a single ESP partition spanning the entire disk.
-func FormatDiskForSinglePartition(name string, useGpt bool) error {
-	disk, err := diskfs.Open(name, diskfs.WithOpenMode(diskfs.ReadWrite))
+// diskLayout describes the partitions created by FormatDiskForSinglePartition (which has no
+// secondary partition) and FormatDiskForUEFINTFS, in logical blocks. Both can add a data partition
+// at the end of the disk.
+type diskLayout struct {
+	primaryStart, primarySize     int64
+	secondaryStart, secondarySize int64
+	dataStart, dataSize           int64
+}
+
+// computeDiskLayout lays out the partitions on a disk of the given size in bytes, with a data
+// partition of the given size in bytes (if not 0). It returns an error if the disk is too small.
+func computeDiskLayout(diskSize int64, logicalBlockSize int64, useGpt bool, singlePartition bool, dataSize int64) (diskLayout, error) {
+	var layout diskLayout
+	mib := int64(1024*1024 /* 1 MiB */) / logicalBlockSize
+	diskLBAs := diskSize / logicalBlockSize
+	if !useGpt {
+		// Leave the rest of the disk unused rather than letting the partitions wrap around
+		diskLBAs = min(diskLBAs, mbrMaxLBAs)
+	} else {
+		// Reserve 1 MiB at the end for the backup GPT just like fdisk, which is 2048 sectors at
+		// 512 bytes/sector, but only 256 sectors at 4096 bytes/sector
+		diskLBAs -= mib
+	}
+	layout.primaryStart = mib
+	if !singlePartition {
+		layout.secondarySize = mib // UEFI:NTFS partition
+	}
+	layout.primarySize = diskLBAs - layout.primaryStart - layout.secondarySize - dataSize/logicalBlockSize
+	if dataSize > 0 {
+		// Align the data partition to 1 MiB, giving it any space left over at the end
+		layout.primarySize -= layout.primarySize % mib
+		layout.dataStart = layout.primaryStart + layout.primarySize + layout.secondarySize
+		layout.dataSize = diskLBAs - layout.dataStart
+	}
+	if layout.primarySize < mib {
+		if dataSize > 0 {
+			return layout, fmt.Errorf("disk is too small for a %s data partition",
+				imaging.BytesToString(int(dataSize), true))
+		}
+		return layout, errors.New("disk is too small to be partitioned")
+	}
+	if !singlePartition {
+		layout.secondaryStart = layout.primaryStart + layout.primarySize
+	}
+	return layout, nil
+}
+
+// expectedPartitions returns the partitions the OS should create for the layout, in bytes.
+func (l diskLayout) expectedPartitions(logicalBlockSize int64) []ExpectedPartition {
+	partitions := []ExpectedPartition{
+		{Number: 1, Start: l.primaryStart * logicalBlockSize, Size: l.primarySize * logicalBlockSize},
+	}
+	if l.secondarySize > 0 {
+		partitions = append(partitions, ExpectedPartition{
+			Number: 2, Start: l.secondaryStart * logicalBlockSize, Size: l.secondarySize * logicalBlockSize})
+	}
+	if l.dataSize > 0 {
+		partitions = append(partitions, ExpectedPartition{
+			Number: len(partitions) + 1, Start: l.dataStart * logicalBlockSize, Size: l.dataSize * logicalBlockSize})
+	}
+	return partitions
+}
+
+// addDataPartition adds the data partition of a layout to a partition table, if there is one.
+func addDataPartition(table partition.Table, layout diskLayout, data *DataPartition) {
+	if layout.dataSize == 0 {
+		return
+	}
+	switch table := table.(type) {
+	case *gpt.Table:
+		table.Partitions = append(table.Partitions, &gpt.Partition{
+			Index: len(table.Partitions) + 1, Start: uint64(layout.dataStart),
+			End: uint64(layout.dataStart + layout.dataSize - 1), Type: gpt.MicrosoftBasicData, Name: dataPartitionName})
+	case *mbr.Table:
+		partitionType := mbr.NTFS // Also used for exFAT
+		if data.Filesystem == "fat32" {
+			partitionType = mbr.Fat32LBA
+		}
+		table.Partitions = append(table.Partitions, &mbr.Partition{
+			Start: uint32(layout.dataStart), Size: uint32(layout.dataSize), Type: partitionType, Bootable: false})
+	}
+}
+
+// ExpectedPartition is a partition which should exist on a disk once the OS has read its partition
+// table, with its start and size in bytes.
+type ExpectedPartition struct {
+	Number      int
+	Start, Size int64
+}
+
+// partitionWaitTimeout is how long to wait for the OS to create the device nodes of partitions.
+const partitionWaitTimeout = 10 * time.Second
+
+// writePartitionTable writes a partition table to a disk, then makes the OS read it and waits for
+// the device nodes of the new partitions to appear, so they can be formatted right away.
+func writePartitionTable(d *disk.Disk, name string, table partition.Table, partitions []ExpectedPartition) error {
+	writable, err := d.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	if err := table.Write(writable, d.Size); err != nil {
+		return fmt.Errorf("failed to create partition table: %w", err)
+	}
+	stat, err := d.Backend.Stat()
+	if err != nil {
+		return err
+	} else if stat.Mode()&os.ModeDevice == 0 {
+		return nil // Disk images have no partition device nodes
+	}
+	device, err := d.Backend.Sys()
+	if err != nil {
+		return err
+	}
+	return ReloadPartitionTable(name, device, partitions)
+}
+
+// waitForPartitions polls until checkPartition succeeds for every expected partition, returning
+// the last error from checkPartition if it times out.
+func waitForPartitions(partitions []ExpectedPartition, checkPartition func(ExpectedPartition) error) error {
+	deadline := time.Now().Add(partitionWaitTimeout)
+	for _, partition := range partitions {
+		for {
+			err := checkPartition(partition)
+			if err == nil {
+				break
+			} else if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for partition %d to appear: %w", partition.Number, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// GetPrimaryPartitionCapacity returns the size in bytes of the primary partition which would be
+// created on a disk by FormatDiskForSinglePartition or FormatDiskForUEFINTFS, alongside a data
+// partition of the given size in bytes (if not 0).
+func GetPrimaryPartitionCapacity(name string, useGpt bool, singlePartition bool, dataSize int64) (int64, error) {
+	disk, err := openDisk(name, diskfs.ReadOnly)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open destination: %v", err)
+	}
+	defer disk.Close()
+	layout, err := computeDiskLayout(disk.Size, disk.LogicalBlocksize, useGpt, singlePartition, dataSize)
+	if err != nil {
+		return 0, err
+	}
+	return layout.primarySize * disk.LogicalBlocksize, nil
+}
+
+// GetMBRUsableSize returns the size in bytes of a disk, and how much of it can be addressed by MBR
+// partitions, which is less than the size of disks larger than 2 TiB (or 16 TiB for 4Kn disks).
+func GetMBRUsableSize(name string) (usable int64, total int64, err error) {
+	disk, err := openDisk(name, diskfs.ReadOnly)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open destination: %v", err)
+	}
+	defer disk.Close()
+	return min(disk.Size, mbrMaxLBAs*disk.LogicalBlocksize), disk.Size, nil
+}
+
+// FormatDiskForSinglePartition formats a disk with a single ESP partition spanning the entire disk,
+// or everything but the data partition if one is given.
+func FormatDiskForSinglePartition(name string, useGpt bool, data *DataPartition) error {
+	disk, err := openDisk(name, diskfs.ReadWrite)
 	if err != nil {
 		return fmt.Errorf("failed to open destination: %v", err)
 	}
 	defer disk.Close()
 
-	primaryPartitionStart := int64(1024*1024 /* 1 MiB */) / disk.LogicalBlocksize
-	primaryPartitionSize := (disk.Size / disk.LogicalBlocksize) - primaryPartitionStart
+	layout, err := computeDiskLayout(disk.Size, disk.LogicalBlocksize, useGpt, true, dataPartitionSize(data))
+	if err != nil {
+		return err
+	}
+	primaryPartitionStart := layout.primaryStart
+	primaryPartitionSize := layout.primarySize
 
 	var table partition.Table
 	if useGpt {
-		// Reserve 2048 sectors at the end just like fdisk
-		primaryPartitionSize -= 2048
 		primaryPartitionEnd := primaryPartitionStart + primaryPartitionSize - 1
 		table = &gpt.Table{
-			ProtectiveMBR: true,
+			LogicalSectorSize:  int(disk.LogicalBlocksize),
+			PhysicalSectorSize: int(disk.PhysicalBlocksize),
+			ProtectiveMBR:      true,
 			Partitions: []*gpt.Partition{
 				// Apparently, Microsoft hates if you have an ESP on your GPT-bootable drive and another ESP on the main system...
 				// Source: https://github.com/pbatard/rufus/blob/6d8fbf98305ff37eb531c45cbd6ff44563c53917/src/drive.c#L2479
 				// Not verified myself, but preventatively align with Rufus by setting type MicrosoftBasicData.
 				// Also, same reasoning for MBR applies here.
-				{Start: uint64(primaryPartitionStart), End: uint64(primaryPartitionEnd), Type: gpt.MicrosoftBasicData, Name: "Windows ISO"},
+				{Index: 1, Start: uint64(primaryPartitionStart), End: uint64(primaryPartitionEnd), Type: gpt.MicrosoftBasicData, Name: "Windows ISO"},
 			},
 		}
 	} else {
@@ -87,41 +277,41 @@ func FormatDiskForSinglePartition(name string, useGpt bool) error {
 		}
 	}
 
-	if err := disk.Partition(table); err != nil {
-		return fmt.Errorf("failed to create partition table: %w", err)
-	}
-	time.Sleep(time.Second) // Wait for the OS to recognize the new partition table
-	return nil
+	addDataPartition(table, layout, data)
+	return writePartitionTable(disk, name, table, layout.expectedPartitions(disk.LogicalBlocksize))
 }
 
 // FormatDiskForUEFINTFS formats a disk with 2 partitions:
 // - A 1 MiB FAT32 ESP partition holding UEFI:NTFS
 // - The remaining disk is spanned by an mbr.NTFS / gpt.MicrosoftBasicData partition
-func FormatDiskForUEFINTFS(name string, useGpt bool) error {
-	disk, err := diskfs.Open(name, diskfs.WithOpenMode(diskfs.ReadWrite))
+//
+// If a data partition is given, it is added as the third partition at the end of the disk.
+func FormatDiskForUEFINTFS(name string, useGpt bool, data *DataPartition) error {
+	disk, err := openDisk(name, diskfs.ReadWrite)
 	if err != nil {
 		return fmt.Errorf("failed to open destination: %v", err)
 	}
 	defer disk.Close()
 
+	layout, err := computeDiskLayout(disk.Size, disk.LogicalBlocksize, useGpt, false, dataPartitionSize(data))
+	if err != nil {
+		return err
+	}
 	// Windows partition
-	primaryPartitionStart := int64(1024*1024 /* 1 MiB */) / disk.LogicalBlocksize
-	primaryPartitionSize := (disk.Size / disk.LogicalBlocksize) - (primaryPartitionStart * 2) // primaryPartitionStart + UEFI:NTFS partition
+	primaryPartitionStart := layout.primaryStart
+	primaryPartitionSize := layout.primarySize
 	primaryPartitionEnd := primaryPartitionStart + primaryPartitionSize - 1
 	// UEFI:NTFS partition
-	secondaryPartitionStart := primaryPartitionEnd + 1
-	secondaryPartitionSize := int64(1024*1024 /* 1 MiB */) / disk.LogicalBlocksize
+	secondaryPartitionStart := layout.secondaryStart
+	secondaryPartitionSize := layout.secondarySize
 	secondaryPartitionEnd := secondaryPartitionStart + secondaryPartitionSize - 1
 
 	var table partition.Table
 	if useGpt {
-		// Reserve 2048 sectors at the end just like fdisk
-		secondaryPartitionStart -= 2048
-		secondaryPartitionEnd -= 2048
-		primaryPartitionSize -= 2048
-		primaryPartitionEnd := primaryPartitionStart + primaryPartitionSize - 1
 		table = &gpt.Table{
-			ProtectiveMBR: true,
+			LogicalSectorSize:  int(disk.LogicalBlocksize),
+			PhysicalSectorSize: int(disk.PhysicalBlocksize),
+			ProtectiveMBR:      true,
 			Partitions: []*gpt.Partition{
 				{Index: 1, Start: uint64(primaryPartitionStart), End: uint64(primaryPartitionEnd), Type: gpt.MicrosoftBasicData, Name: "Windows ISO"},
 				// Apparently, Microsoft hates if you have an ESP on your GPT-bootable drive and another ESP on the main system...
@@ -142,22 +332,185 @@ func FormatDiskForUEFINTFS(name string, useGpt bool) error {
 		}
 	}
 
-	if err := disk.Partition(table); err != nil {
-		return fmt.Errorf("failed to create partition table: %w", err)
+	addDataPartition(table, layout, data)
+	return writePartitionTable(disk, name, table, layout.expectedPartitions(disk.LogicalBlocksize))
+}
+
+// CheckDiskLayout checks that a disk has the partition layout that FormatDiskForSinglePartition (if
+// singlePartition is true) or FormatDiskForUEFINTFS would have created on it, with a data partition
+// at the end if dataPartition is true.
+func CheckDiskLayout(name string, useGpt bool, singlePartition bool, dataPartition bool) error {
+	disk, err := openDisk(name, diskfs.ReadOnly)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %v", err)
+	}
+	defer disk.Close()
+
+	table, err := disk.GetPartitionTable()
+	if err != nil {
+		return fmt.Errorf("failed to read partition table: %w", err)
+	}
+	uefiNTFSPartitionSize := int64(1024*1024 /* 1 MiB */) / disk.LogicalBlocksize
+	expected := 2
+	if singlePartition {
+		expected = 1
+	}
+	if dataPartition {
+		expected++
+	}
+	switch table := table.(type) {
+	case *gpt.Table:
+		if !useGpt {
+			return fmt.Errorf("expected an MBR partition table, found GPT")
+		}
+		if len(table.Partitions) != expected {
+			return fmt.Errorf("expected %d partitions, found %d", expected, len(table.Partitions))
+		}
+		if table.Partitions[0].Type != gpt.MicrosoftBasicData || table.Partitions[0].Name != "Windows ISO" {
+			return fmt.Errorf("partition 1 is not a glassUSB Windows ISO partition")
+		}
+		if !singlePartition {
+			uefiNTFS := table.Partitions[1]
+			if uefiNTFS.Type != gpt.MicrosoftBasicData || uefiNTFS.Name != "UEFI:NTFS" ||
+				int64(uefiNTFS.End-uefiNTFS.Start+1) != uefiNTFSPartitionSize {
+				return fmt.Errorf("partition 2 is not a glassUSB UEFI:NTFS partition")
+			}
+		}
+		// glassUSB puts the data partition right after its other partitions
+		if data := table.Partitions[expected-1]; dataPartition && (data.Type != gpt.MicrosoftBasicData ||
+			data.Name != dataPartitionName || data.Start != table.Partitions[expected-2].End+1) {
+			return fmt.Errorf("partition %d is not a glassUSB data partition", expected)
+		}
+	case *mbr.Table:
+		if useGpt {
+			return fmt.Errorf("expected a GPT partition table, found MBR")
+		}
+		partitions := []*mbr.Partition{}
+		for _, partition := range table.Partitions {
+			if partition.Type != mbr.Empty {
+				partitions = append(partitions, partition)
+			}
+		}
+		if len(partitions) != expected {
+			return fmt.Errorf("expected %d partitions, found %d", expected, len(partitions))
+		}
+		if singlePartition {
+			if partitions[0].Type != mbr.Fat32LBA || !partitions[0].Bootable {
+				return fmt.Errorf("partition 1 is not a bootable FAT32 partition")
+			}
+		} else {
+			if partitions[0].Type != mbr.NTFS || !partitions[0].Bootable {
+				return fmt.Errorf("partition 1 is not a bootable NTFS/exFAT partition")
+			} else if partitions[1].Type != mbr.EFISystem || int64(partitions[1].Size) != uefiNTFSPartitionSize {
+				return fmt.Errorf("partition 2 is not a glassUSB UEFI:NTFS partition")
+			}
+		}
+		if data, previous := partitions[expected-1], partitions[max(expected-2, 0)]; dataPartition &&
+			((data.Type != mbr.NTFS && data.Type != mbr.Fat32LBA) || data.Bootable ||
+				data.Start != previous.Start+previous.Size) {
+			return fmt.Errorf("partition %d is not a glassUSB FAT32/NTFS/exFAT data partition", expected)
+		}
+	default:
+		return fmt.Errorf("unknown partition table type: %s", table.Type())
+	}
+	return nil
+}
+
+// DetectDiskLayout reads the partition table of a disk, returning whether it uses GPT, whether it
+// has a single partition and whether it has a data partition, i.e. the options FormatDiskFor* would
+// have been called with to create it. The layout should be checked with CheckDiskLayout afterwards.
+func DetectDiskLayout(name string) (useGpt bool, singlePartition bool, dataPartition bool, err error) {
+	disk, err := openDisk(name, diskfs.ReadOnly)
+	if err != nil {
+		return false, false, false, fmt.Errorf("failed to open destination: %v", err)
+	}
+	defer disk.Close()
+
+	table, err := disk.GetPartitionTable()
+	if err != nil {
+		return false, false, false, fmt.Errorf("failed to read partition table: %w", err)
+	}
+	// Partition 2 is UEFI:NTFS unless there's a single partition, and anything after is a data partition
+	switch table := table.(type) {
+	case *gpt.Table:
+		singlePartition = len(table.Partitions) < 2 || table.Partitions[1].Name != "UEFI:NTFS"
+		return true, singlePartition, len(table.Partitions) > 2 || (singlePartition && len(table.Partitions) == 2), nil
+	case *mbr.Table:
+		partitions := []*mbr.Partition{}
+		for _, partition := range table.Partitions {
+			if partition.Type != mbr.Empty {
+				partitions = append(partitions, partition)
+			}
+		}
+		singlePartition = len(partitions) < 2 || partitions[1].Type != mbr.EFISystem
+		return false, singlePartition, len(partitions) > 2 || (singlePartition && len(partitions) == 2), nil
+	}
+	return false, false, false, fmt.Errorf("unknown partition table type: %s", table.Type())
+}
+
+// partitionExtent returns the offset and size in bytes of a partition on a disk. Unlike the
+// partitions go-diskfs reads from MBRs, it accounts for disks without 512-byte logical sectors.
+func partitionExtent(d *disk.Disk, index int) (offset int64, size int64, err error) {
+	table, err := d.GetPartitionTable()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read partition table: %w", err)
+	}
+	switch table := table.(type) {
+	case *gpt.Table:
+		for _, partition := range table.Partitions {
+			if partition.Index == index {
+				return int64(partition.Start) * d.LogicalBlocksize,
+					int64(partition.End-partition.Start+1) * d.LogicalBlocksize, nil
+			}
+		}
+	case *mbr.Table:
+		if index >= 1 && index <= len(table.Partitions) && table.Partitions[index-1].Type != mbr.Empty {
+			partition := table.Partitions[index-1]
+			return int64(partition.Start) * d.LogicalBlocksize, int64(partition.Size) * d.LogicalBlocksize, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("partition %d not found", index)
+}
+
+// CheckUEFINTFSPartition checks that a partition contains the UEFI:NTFS image glassUSB writes.
+func CheckUEFINTFSPartition(name string, partition int) error {
+	disk, err := openDisk(name, diskfs.ReadOnly)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %v", err)
+	}
+	defer disk.Close()
+
+	offset, size, err := partitionExtent(disk, partition)
+	if err != nil {
+		return fmt.Errorf("failed to read UEFI:NTFS partition contents: %w", err)
+	}
+	contents := make([]byte, min(size, int64(len(UEFI_NTFS_IMG))))
+	if _, err := disk.Backend.ReadAt(contents, offset); err != nil {
+		return fmt.Errorf("failed to read UEFI:NTFS partition contents: %w", err)
+	} else if !bytes.Equal(contents, UEFI_NTFS_IMG) {
+		return fmt.Errorf("partition %d does not contain the UEFI:NTFS image bundled with glassUSB", partition)
 	}
-	time.Sleep(time.Second) // Wait for the OS to recognize the new partition table
 	return nil
 }
 
 // WriteUEFINTFSToPartition writes the UEFI:NTFS image to the specified partition on the device.
 func WriteUEFINTFSToPartition(name string, partition int) error {
-	disk, err := diskfs.Open(name, diskfs.WithOpenMode(diskfs.ReadWrite))
+	disk, err := openDisk(name, diskfs.ReadWrite)
 	if err != nil {
 		return fmt.Errorf("failed to open destination: %v", err)
 	}
 	defer disk.Close()
 
-	if _, err := disk.WritePartitionContents(partition, bytes.NewReader(UEFI_NTFS_IMG)); err != nil {
+	offset, size, err := partitionExtent(disk, partition)
+	if err != nil {
+		return fmt.Errorf("failed to write UEFI:NTFS contents to partition: %w", err)
+	} else if size < int64(len(UEFI_NTFS_IMG)) {
+		return fmt.Errorf("failed to write UEFI:NTFS contents to partition: partition %d is too small", partition)
+	}
+	writable, err := disk.Backend.Writable()
+	if err != nil {
+		return fmt.Errorf("failed to write UEFI:NTFS contents to partition: %w", err)
+	} else if _, err := writable.WriteAt(UEFI_NTFS_IMG, offset); err != nil {
 		return fmt.Errorf("failed to write UEFI:NTFS contents to partition: %w", err)
 	}
 	return nil
@@ -3,15 +3,18 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
 
 	"github.com/diskfs/go-diskfs"
 	"golang.org/x/sys/unix"
 )
 
-func GetBlockDevicePartition(blockDevice string, partNumber int) string {
-	return blockDevice + "s" + strconv.Itoa(partNumber)
+func GetBlockDevicePartition(blockDevice string, partNumber int) (string, error) {
+	return blockDevice + "s" + strconv.Itoa(partNumber), nil
 }
 
 func GetBlockDeviceSize(blockDevice string) (int64, error) {
@@ -34,3 +37,32 @@ func GetBlockDeviceSize(blockDevice string) (int64, error) {
 	}
 	return int64(blockSize) * int64(blockCount), nil
 }
+
+// GetDeviceIdentity returns the model and serial number of a block device. macOS doesn't expose the
+// serial number of USB drives through diskutil, so it is always empty.
+func GetDeviceIdentity(blockDevice string) (model string, serial string, err error) {
+	out, err := exec.Command("diskutil", "info", blockDevice).CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get device info: %w\noutput: %s", err, out)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), "Device / Media Name:"); ok {
+			model = strings.TrimSpace(name)
+		}
+	}
+	return model, "", nil
+}
+
+// ReloadPartitionTable waits for macOS to create the device nodes of the expected partitions with
+// the expected sizes, which it does by itself after the partition table is written.
+func ReloadPartitionTable(blockDevice string, device *os.File, partitions []ExpectedPartition) error {
+	return waitForPartitions(partitions, func(partition ExpectedPartition) error {
+		node, _ := GetBlockDevicePartition(blockDevice, partition.Number)
+		if size, err := GetBlockDeviceSize(node); err != nil {
+			return err
+		} else if size != partition.Size {
+			return fmt.Errorf("%s is %d bytes, expected %d bytes", node, size, partition.Size)
+		}
+		return nil
+	})
+}
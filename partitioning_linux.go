@@ -3,19 +3,87 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-func GetBlockDevicePartition(blockDevice string, partNumber int) string {
-	blockDevicePartition := blockDevice
-	if blockDevice[len(blockDevice)-1] >= '0' && blockDevice[len(blockDevice)-1] <= '9' {
-		blockDevicePartition += "p"
+// GetBlockDevicePartition returns the device node of a partition of a block device, which is found
+// in sysfs, as partitions aren't named consistently, and the block device may be a symlink such as
+// /dev/disk/by-id/...
+func GetBlockDevicePartition(blockDevice string, partNumber int) (string, error) {
+	disk, err := getSysfsBlockDevice(blockDevice)
+	if err != nil {
+		return "", err
+	}
+	partition, err := findKernelPartition(disk, partNumber)
+	if err != nil {
+		return "", fmt.Errorf("failed to find partition %d of %s: %w", partNumber, blockDevice, err)
+	}
+	return getDeviceNode(partition), nil
+}
+
+// getSysfsBlockDevice returns the directory of a block device in sysfs. It is found by device
+// number rather than name, so symlinks and device nodes with unusual names work too.
+func getSysfsBlockDevice(blockDevice string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(blockDevice, &stat); err != nil {
+		return "", fmt.Errorf("failed to get info about %s: %w", blockDevice, err)
+	} else if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", blockDevice)
+	}
+	rdev := uint64(stat.Rdev)
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(rdev), unix.Minor(rdev)))
+	if err != nil {
+		return "", fmt.Errorf("failed to find %s in sysfs: %w", blockDevice, err)
+	}
+	return dir, nil
+}
+
+// findKernelPartition returns the sysfs directory of a partition of a block device in sysfs.
+func findKernelPartition(disk string, partNumber int) (string, error) {
+	entries, err := os.ReadDir(disk)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(disk, entry.Name(), "partition"))
+		if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(partNumber) {
+			return filepath.Join(disk, entry.Name()), nil
+		}
+	}
+	// Partitions of device-mapper devices (e.g. multipath) are device-mapper devices stacked on top
+	holders, _ := os.ReadDir(filepath.Join(disk, "holders"))
+	for _, holder := range holders {
+		uuid, _ := os.ReadFile(filepath.Join(disk, "holders", holder.Name(), "dm", "uuid"))
+		if strings.HasPrefix(string(uuid), "part"+strconv.Itoa(partNumber)+"-") {
+			return filepath.EvalSymlinks(filepath.Join(disk, "holders", holder.Name()))
+		}
 	}
-	return blockDevicePartition + strconv.Itoa(partNumber)
+	if partscan, err := os.ReadFile(filepath.Join(disk, "partscan")); err == nil &&
+		strings.TrimSpace(string(partscan)) == "0" {
+		return "", errors.New("partition scanning is disabled, set up the loop device with `losetup --partscan`")
+	}
+	return "", errors.New("no such partition")
+}
+
+// getDeviceNode returns the device node in /dev of a block device in sysfs.
+func getDeviceNode(dir string) string {
+	uevent, _ := os.ReadFile(filepath.Join(dir, "uevent"))
+	for _, line := range strings.Split(string(uevent), "\n") {
+		if name, ok := strings.CutPrefix(line, "DEVNAME="); ok {
+			return filepath.Join("/dev", name)
+		}
+	}
+	return filepath.Join("/dev", filepath.Base(dir))
 }
 
 func GetBlockDeviceSize(blockDevice string) (int64, error) {
@@ -31,3 +99,213 @@ func GetBlockDeviceSize(blockDevice string) (int64, error) {
 	}
 	return int64(value), nil
 }
+
+// GetDeviceIdentity returns the model and serial number of a block device as reported by the
+// kernel, either of which may be empty if the device doesn't report it.
+func GetDeviceIdentity(blockDevice string) (model string, serial string, err error) {
+	disk, err := getSysfsBlockDevice(blockDevice)
+	if err != nil {
+		return "", "", err
+	}
+	device, err := filepath.EvalSymlinks(filepath.Join(disk, "device"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find %s in sysfs: %w", blockDevice, err)
+	}
+	readAttribute := func(path string) string {
+		value, _ := os.ReadFile(path)
+		return strings.TrimSpace(string(value))
+	}
+	model = strings.TrimSpace(readAttribute(filepath.Join(device, "vendor")) + " " +
+		readAttribute(filepath.Join(device, "model")))
+	// USB drives report their serial on the USB device, a few levels above the SCSI device
+	for dir := device; dir != "/sys" && dir != "/"; dir = filepath.Dir(dir) {
+		if serial = readAttribute(filepath.Join(dir, "serial")); serial != "" {
+			break
+		}
+	}
+	return model, serial, nil
+}
+
+// partitionRereadAttempts is how many times BLKRRPART is tried, as udev briefly opens the disk to
+// probe it after the partition table is written, which makes BLKRRPART fail with EBUSY.
+const partitionRereadAttempts = 5
+
+// ReloadPartitionTable makes the kernel read a newly written partition table, then waits for the
+// device nodes of the expected partitions to appear with the expected sizes.
+func ReloadPartitionTable(blockDevice string, device *os.File, partitions []ExpectedPartition) error {
+	disk, err := getSysfsBlockDevice(blockDevice)
+	if err != nil {
+		return err
+	}
+	var rereadErr error
+	for attempt := 1; ; attempt++ {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, device.Fd(), unix.BLKRRPART, 0)
+		if errno == 0 {
+			rereadErr = nil
+			break
+		}
+		rereadErr = errno
+		if errno != unix.EBUSY || attempt == partitionRereadAttempts {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+	}
+	// If BLKRRPART failed, or the kernel can't parse the partition table, update the partitions
+	// which differ like partx does, which works as long as they aren't in use
+	if err := updateKernelPartitions(device, disk, partitions); err != nil {
+		if rereadErr != nil {
+			err = fmt.Errorf("BLKRRPART: %w, BLKPG: %w", rereadErr, err)
+		}
+		if users := getDiskUsers(disk); len(users) > 0 {
+			return fmt.Errorf("the kernel is still using the old partition table, as %s is in use by %s. "+
+				"Unmount or close it and try again (%w)", blockDevice, strings.Join(users, ", "), err)
+		}
+		return fmt.Errorf("the kernel is still using the old partition table of %s, try again after "+
+			"reconnecting it (%w)", blockDevice, err)
+	}
+	return waitForPartitions(partitions, func(partition ExpectedPartition) error {
+		dir, err := findKernelPartition(disk, partition.Number)
+		if err != nil {
+			return err
+		}
+		node := getDeviceNode(dir)
+		if stat, err := os.Stat(node); err != nil {
+			return err
+		} else if stat.Mode()&os.ModeDevice == 0 {
+			return fmt.Errorf("%s is not a block device", node)
+		}
+		start, size := readKernelPartition(dir)
+		if start != partition.Start || size != partition.Size {
+			return fmt.Errorf("%s is %d bytes at offset %d, expected %d bytes at offset %d",
+				node, size, start, partition.Size, partition.Start)
+		}
+		return nil
+	})
+}
+
+// readKernelPartition reads the start and size in bytes of a partition in sysfs, which are always
+// in 512-byte units regardless of the logical block size. Both are -1 if they can't be read.
+func readKernelPartition(dir string) (start int64, size int64) {
+	readSectors := func(attribute string) int64 {
+		data, err := os.ReadFile(filepath.Join(dir, attribute))
+		if err != nil {
+			return -1
+		}
+		sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return -1
+		}
+		return sectors * 512
+	}
+	return readSectors("start"), readSectors("size")
+}
+
+// updateKernelPartitions uses BLKPG to delete and add the partitions of a disk in the kernel which
+// differ from the expected partitions, leaving other partitions untouched.
+func updateKernelPartitions(device *os.File, disk string, partitions []ExpectedPartition) error {
+	existing := make(map[int][2]int64)
+	entries, err := os.ReadDir(disk)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(disk, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "partition"))
+		if err != nil {
+			continue // Not a partition
+		} else if number, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			start, size := readKernelPartition(dir)
+			existing[number] = [2]int64{start, size}
+		}
+	}
+	expected := make(map[int][2]int64)
+	for _, partition := range partitions {
+		expected[partition.Number] = [2]int64{partition.Start, partition.Size}
+	}
+	for number, extent := range existing {
+		if expected[number] != extent {
+			if err := blkpg(device, unix.BLKPG_DEL_PARTITION, number, 0, 0); err != nil {
+				return fmt.Errorf("failed to delete partition %d: %w", number, err)
+			}
+			delete(existing, number)
+		}
+	}
+	for _, partition := range partitions {
+		if _, ok := existing[partition.Number]; !ok {
+			if err := blkpg(device, unix.BLKPG_ADD_PARTITION, partition.Number, partition.Start, partition.Size); err != nil {
+				return fmt.Errorf("failed to add partition %d: %w", partition.Number, err)
+			}
+		}
+	}
+	return nil
+}
+
+func blkpg(device *os.File, op int32, number int, start int64, size int64) error {
+	partition := unix.BlkpgPartition{Start: start, Length: size, Pno: int32(number)}
+	arg := unix.BlkpgIoctlArg{
+		Op:      op,
+		Datalen: int32(unsafe.Sizeof(partition)),
+		Data:    (*byte)(unsafe.Pointer(&partition)),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, device.Fd(), unix.BLKPG, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getDiskUsers returns what is holding a disk or its partitions open, i.e. mount points, other
+// processes and device-mapper or RAID devices stacked on top of them, for error messages.
+func getDiskUsers(disk string) []string {
+	devices := []string{disk}
+	if entries, err := os.ReadDir(disk); err == nil {
+		for _, entry := range entries {
+			if _, err := os.Stat(filepath.Join(disk, entry.Name(), "partition")); err == nil {
+				devices = append(devices, filepath.Join(disk, entry.Name()))
+			}
+		}
+	}
+	nodes := []string{}
+	for _, device := range devices {
+		nodes = append(nodes, getDeviceNode(device))
+	}
+	users := []string{}
+	mounts, _ := os.ReadFile("/proc/self/mounts")
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		source, err := filepath.EvalSymlinks(fields[0])
+		if err == nil && slices.Contains(nodes, source) {
+			users = append(users, fmt.Sprintf("%s mounted at %s", source, fields[1]))
+		}
+	}
+	// Processes with the partitions open, e.g. a file manager which opened them after being mounted
+	processes, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range processes {
+		target, err := os.Readlink(fd)
+		pid := strings.Split(fd, "/")[2]
+		if err != nil || pid == strconv.Itoa(os.Getpid()) || !slices.Contains(nodes, target) {
+			continue
+		}
+		command, _ := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+		user := fmt.Sprintf("%s (PID %s)", strings.TrimSpace(string(command)), pid)
+		if !slices.Contains(users, user) {
+			users = append(users, user)
+		}
+	}
+	for _, device := range devices {
+		holders, _ := os.ReadDir(filepath.Join(device, "holders"))
+		for _, holder := range holders {
+			// Device-mapper devices have a name, e.g. the name of an unlocked LUKS volume
+			dmName, _ := os.ReadFile(filepath.Join(device, "holders", holder.Name(), "dm", "name"))
+			if dmName := strings.TrimSpace(string(dmName)); dmName != "" {
+				users = append(users, fmt.Sprintf("/dev/%s (%s)", holder.Name(), dmName))
+			} else {
+				users = append(users, "/dev/"+holder.Name())
+			}
+		}
+	}
+	return users
+}
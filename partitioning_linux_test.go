@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setUpLoopDevice(t *testing.T, partscan bool) string {
+	img := t.TempDir() + "/test.img"
+	if err := os.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.Truncate(img, 64*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--find", "--show", img}
+	if partscan {
+		args = append(args, "--partscan")
+	}
+	out, err := exec.Command("losetup", args...).Output()
+	if err != nil {
+		t.Skipf("loop devices are not available: %v", err)
+	}
+	loopDevice := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("losetup", "--detach", loopDevice).Run() })
+	return loopDevice
+}
+
+func TestReloadPartitionTableOnLoopDevice(t *testing.T) {
+	loopDevice := setUpLoopDevice(t, true)
+	// Partitions are found through symlinks like /dev/disk/by-id/... too
+	symlink := filepath.Join(t.TempDir(), "usb-Example_Drive_1234")
+	if err := os.Symlink(loopDevice, symlink); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FormatDiskForUEFINTFS(symlink, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	uefiNTFSPartition, err := GetBlockDevicePartition(symlink, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if uefiNTFSPartition != loopDevice+"p2" {
+		t.Errorf("expected partition 2 to be %sp2, got %s", loopDevice, uefiNTFSPartition)
+	} else if size, err := GetBlockDeviceSize(uefiNTFSPartition); err != nil {
+		t.Fatal(err)
+	} else if size != 1024*1024 {
+		t.Errorf("UEFI:NTFS partition is %d bytes, expected 1 MiB", size)
+	}
+
+	// The partitions can't be replaced while one of them is open, and the GPT layout is smaller
+	primaryPartition, err := GetBlockDevicePartition(symlink, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partition, err := os.Open(primaryPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = FormatDiskForUEFINTFS(symlink, true, nil)
+	partition.Close()
+	if err == nil || !strings.Contains(err.Error(), "old partition table") {
+		t.Errorf("expected busy partition to prevent reloading the partition table, got %v", err)
+	}
+	if err := FormatDiskForSinglePartition(symlink, true, nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := GetBlockDevicePartition(symlink, 2); err == nil {
+		t.Error("expected UEFI:NTFS partition to be removed")
+	}
+
+	data := &DataPartition{Size: 16 * 1024 * 1024, Filesystem: "exfat", Label: "Tools"}
+	if err := FormatDiskForUEFINTFS(symlink, false, data); err != nil {
+		t.Fatal(err)
+	} else if dataPartition, err := GetBlockDevicePartition(symlink, 3); err != nil {
+		t.Fatal(err)
+	} else if size, err := GetBlockDeviceSize(dataPartition); err != nil {
+		t.Fatal(err)
+	} else if size != data.Size {
+		t.Errorf("data partition is %d bytes, expected %d", size, data.Size)
+	}
+}
+
+func TestGetBlockDevicePartitionWithoutPartscan(t *testing.T) {
+	loopDevice := setUpLoopDevice(t, false)
+	if _, err := GetBlockDevicePartition(loopDevice, 1); err == nil || !strings.Contains(err.Error(), "--partscan") {
+		t.Errorf("expected an error suggesting --partscan, got %v", err)
+	}
+}
+
+func TestFindKernelPartition(t *testing.T) {
+	sysfs := t.TempDir()
+	writeAttribute := func(path string, value string) {
+		os.MkdirAll(filepath.Join(sysfs, filepath.Dir(path)), 0755)
+		if err := os.WriteFile(filepath.Join(sysfs, path), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A multipath device, whose partitions are device-mapper devices stacked on top of it
+	writeAttribute("dm-0/uevent", "MAJOR=253\nMINOR=0\nDEVNAME=dm-0\nDEVTYPE=disk")
+	writeAttribute("dm-1/dm/uuid", "part1-mpath-3600508b400105e210000900000490000")
+	writeAttribute("dm-1/uevent", "MAJOR=253\nMINOR=1\nDEVNAME=dm-1\nDEVTYPE=disk")
+	os.MkdirAll(filepath.Join(sysfs, "dm-0", "holders"), 0755)
+	os.Symlink(filepath.Join(sysfs, "dm-1"), filepath.Join(sysfs, "dm-0", "holders", "dm-1"))
+	// A disk with an unusually named partition
+	writeAttribute("mmcblk0/mmcblk0p1/partition", "1")
+	writeAttribute("mmcblk0/mmcblk0p1/uevent", "DEVNAME=mmcblk0p1\nPARTN=1")
+	writeAttribute("mmcblk0/mmcblk0boot0/uevent", "DEVNAME=mmcblk0boot0")
+
+	if partition, err := findKernelPartition(filepath.Join(sysfs, "dm-0"), 1); err != nil {
+		t.Fatal(err)
+	} else if node := getDeviceNode(partition); node != "/dev/dm-1" {
+		t.Errorf("expected multipath partition to be /dev/dm-1, got %s", node)
+	}
+	if _, err := findKernelPartition(filepath.Join(sysfs, "dm-0"), 2); err == nil {
+		t.Error("expected missing multipath partition to fail")
+	}
+	if partition, err := findKernelPartition(filepath.Join(sysfs, "mmcblk0"), 1); err != nil {
+		t.Fatal(err)
+	} else if node := getDeviceNode(partition); node != "/dev/mmcblk0p1" {
+		t.Errorf("expected partition to be /dev/mmcblk0p1, got %s", node)
+	}
+}
@@ -2,10 +2,25 @@
 
 package main
 
-func GetBlockDevicePartition(blockDevice string, partNumber int) string {
-	panic("GetBlockDevicePartition is only implemented on Linux")
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+func GetBlockDevicePartition(blockDevice string, partNumber int) (string, error) {
+	return "", errors.ErrUnsupported
 }
 
 func GetBlockDeviceSize(blockDevice string) (int64, error) {
 	panic("GetBlockDeviceSize is only implemented on Linux")
 }
+
+func GetDeviceIdentity(blockDevice string) (model string, serial string, err error) {
+	return "", "", errors.ErrUnsupported
+}
+
+func ReloadPartitionTable(blockDevice string, device *os.File, partitions []ExpectedPartition) error {
+	time.Sleep(time.Second) // Wait for the OS to recognize the new partition table
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"os"
 	"testing"
 
@@ -36,7 +37,7 @@ func TestWipeStaleGPTMetadata(t *testing.T) {
 	}
 	disk.Close()
 
-	if err := FormatDiskForUEFINTFS(img, false); err != nil {
+	if err := FormatDiskForUEFINTFS(img, false, nil); err != nil {
 		t.Fatalf("FormatDiskForUEFINTFS: %v", err)
 	}
 
@@ -97,10 +98,262 @@ func TestFormatDiskForUEFINTFSWithValidStaleGPT(t *testing.T) {
 	}
 	disk.Close()
 
-	if err := FormatDiskForUEFINTFS(img, false); err != nil {
+	if err := FormatDiskForUEFINTFS(img, false, nil); err != nil {
 		t.Fatalf("FormatDiskForUEFINTFS: %v", err)
 	}
 	if err := WriteUEFINTFSToPartition(img, 2); err != nil {
 		t.Fatalf("WriteUEFINTFSToPartition: %v", err)
 	}
 }
+
+func TestDetectDiskLayout(t *testing.T) {
+	for _, test := range []struct {
+		useGpt          bool
+		singlePartition bool
+		dataPartition   bool
+	}{
+		{false, false, false}, {false, true, false}, {true, false, false}, {true, true, false},
+		{false, false, true}, {false, true, true}, {true, false, true}, {true, true, true},
+	} {
+		img := t.TempDir() + "/test.img"
+		if err := os.WriteFile(img, nil, 0644); err != nil {
+			t.Fatal(err)
+		} else if err := os.Truncate(img, 64*1024*1024); err != nil {
+			t.Fatal(err)
+		}
+		var data *DataPartition
+		if test.dataPartition {
+			data = &DataPartition{Size: 16 * 1024 * 1024, Filesystem: "exfat", Label: "Tools"}
+		}
+		var err error
+		if test.singlePartition {
+			err = FormatDiskForSinglePartition(img, test.useGpt, data)
+		} else {
+			err = FormatDiskForUEFINTFS(img, test.useGpt, data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layout := describeDiskLayout(test.useGpt, test.singlePartition, test.dataPartition)
+		useGpt, singlePartition, dataPartition, err := DetectDiskLayout(img)
+		if err != nil {
+			t.Fatalf("%s: DetectDiskLayout: %v", layout, err)
+		} else if useGpt != test.useGpt || singlePartition != test.singlePartition || dataPartition != test.dataPartition {
+			t.Errorf("%s: detected %s instead", layout, describeDiskLayout(useGpt, singlePartition, dataPartition))
+		} else if err := CheckDiskLayout(img, useGpt, singlePartition, dataPartition); err != nil {
+			t.Errorf("%s: CheckDiskLayout: %v", layout, err)
+		} else if err := CheckDiskLayout(img, useGpt, singlePartition, !dataPartition); err == nil {
+			t.Errorf("%s: expected CheckDiskLayout to fail when the data partition option differs", layout)
+		}
+		if test.dataPartition {
+			disk, err := openDisk(img, diskfs.ReadOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+			number := 3
+			if test.singlePartition {
+				number = 2
+			}
+			offset, size, err := partitionExtent(disk, number)
+			disk.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", layout, err)
+			} else if offset%(1024*1024) != 0 || size < data.Size {
+				t.Errorf("%s: data partition is at %d+%d, expected a MiB-aligned partition of at least %d bytes",
+					layout, offset, size, data.Size)
+			}
+		}
+		if !test.singlePartition {
+			if err := CheckUEFINTFSPartition(img, 2); err == nil {
+				t.Errorf("%s: expected empty UEFI:NTFS partition to fail the check", layout)
+			}
+			if err := WriteUEFINTFSToPartition(img, 2); err != nil {
+				t.Fatal(err)
+			} else if err := CheckUEFINTFSPartition(img, 2); err != nil {
+				t.Errorf("%s: CheckUEFINTFSPartition: %v", layout, err)
+			}
+		}
+	}
+}
+
+func TestFormatDisk4Kn(t *testing.T) {
+	diskImageSectorSize = diskfs.SectorSize4k
+	t.Cleanup(func() { diskImageSectorSize = diskfs.SectorSizeDefault })
+	const sectorSize = 4096
+	const diskSize = 64 * 1024 * 1024
+	for _, test := range []struct {
+		useGpt          bool
+		singlePartition bool
+	}{{false, false}, {false, true}, {true, false}, {true, true}} {
+		layout := describeDiskLayout(test.useGpt, test.singlePartition, false)
+		img := t.TempDir() + "/test.img"
+		if err := os.WriteFile(img, nil, 0644); err != nil {
+			t.Fatal(err)
+		} else if err := os.Truncate(img, diskSize); err != nil {
+			t.Fatal(err)
+		}
+		// Leave a stale 4Kn GPT behind, which must be wiped when switching to MBR
+		disk, err := openDisk(img, diskfs.ReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale := &gpt.Table{LogicalSectorSize: sectorSize, PhysicalSectorSize: sectorSize, ProtectiveMBR: true,
+			Partitions: []*gpt.Partition{{Index: 1, Start: 256, End: 511, Type: gpt.EFISystemPartition, Name: "EFI"}}}
+		if err := disk.Partition(stale); err != nil {
+			t.Fatal(err)
+		}
+		disk.Close()
+
+		if test.singlePartition {
+			err = FormatDiskForSinglePartition(img, test.useGpt, nil)
+		} else {
+			err = FormatDiskForUEFINTFS(img, test.useGpt, nil)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", layout, err)
+		} else if err := CheckDiskLayout(img, test.useGpt, test.singlePartition, false); err != nil {
+			t.Errorf("%s: CheckDiskLayout: %v", layout, err)
+		}
+
+		disk, err = openDisk(img, diskfs.ReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		primaryOffset, primarySize, err := partitionExtent(disk, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", layout, err)
+		} else if primaryOffset != 1024*1024 {
+			t.Errorf("%s: primary partition starts at byte %d, expected 1 MiB", layout, primaryOffset)
+		}
+		end := primaryOffset + primarySize
+		if !test.singlePartition {
+			secondaryOffset, secondarySize, err := partitionExtent(disk, 2)
+			if err != nil {
+				t.Fatalf("%s: %v", layout, err)
+			} else if secondaryOffset != end || secondarySize != 1024*1024 {
+				t.Errorf("%s: UEFI:NTFS partition is at %d+%d, expected %d+1 MiB", layout, secondaryOffset, secondarySize, end)
+			}
+			end = secondaryOffset + secondarySize
+		}
+		if test.useGpt && end > diskSize-gptMetadataLBAs(sectorSize)*sectorSize {
+			t.Errorf("%s: partitions end at %d, overlapping the backup GPT", layout, end)
+		} else if !test.useGpt && end != diskSize {
+			t.Errorf("%s: partitions end at %d, expected them to span the disk", layout, end)
+		}
+		disk.Close()
+
+		if !test.useGpt {
+			data, _ := os.ReadFile(img)
+			primary := data[sectorSize : sectorSize*(1+gptMetadataLBAs(sectorSize))]
+			backup := data[diskSize-sectorSize*gptMetadataLBAs(sectorSize):]
+			if bytes.Count(primary, []byte{0}) != len(primary) || bytes.Count(backup, []byte{0}) != len(backup) {
+				t.Errorf("%s: stale 4Kn GPT metadata was not wiped", layout)
+			}
+		}
+		if !test.singlePartition {
+			if err := WriteUEFINTFSToPartition(img, 2); err != nil {
+				t.Fatalf("%s: %v", layout, err)
+			} else if err := CheckUEFINTFSPartition(img, 2); err != nil {
+				t.Errorf("%s: CheckUEFINTFSPartition: %v", layout, err)
+			}
+			data, _ := os.ReadFile(img)
+			if !bytes.Equal(data[end-1024*1024:end], UEFI_NTFS_IMG) {
+				t.Errorf("%s: UEFI:NTFS image was not written at the 4Kn partition offset", layout)
+			}
+		}
+	}
+}
+
+func TestFormatDiskLargerThanMBRLimit(t *testing.T) {
+	t.Run("512", func(t *testing.T) {
+		testFormatDiskLargerThanMBRLimit(t, diskfs.SectorSizeDefault, 3*1024*1024*1024*1024)
+	})
+	t.Run("4Kn", func(t *testing.T) {
+		testFormatDiskLargerThanMBRLimit(t, diskfs.SectorSize4k, 17*1024*1024*1024*1024)
+	})
+}
+
+func testFormatDiskLargerThanMBRLimit(t *testing.T, sectorSize diskfs.SectorSize, diskSize int64) {
+	diskImageSectorSize = sectorSize
+	t.Cleanup(func() { diskImageSectorSize = diskfs.SectorSizeDefault })
+	mbrLimit := int64(mbrMaxLBAs) * max(int64(sectorSize), 512)
+	for _, useGpt := range []bool{false, true} {
+		for _, singlePartition := range []bool{false, true} {
+			layout := describeDiskLayout(useGpt, singlePartition, false)
+			img := t.TempDir() + "/test.img"
+			if err := os.WriteFile(img, nil, 0644); err != nil {
+				t.Fatal(err)
+			} else if err := os.Truncate(img, diskSize); err != nil {
+				t.Skipf("sparse files of %d bytes are not supported: %v", diskSize, err)
+			}
+			usable, total, err := GetMBRUsableSize(img)
+			if err != nil {
+				t.Fatal(err)
+			} else if usable != mbrLimit || total != diskSize {
+				t.Errorf("%s: MBR can address %d of %d bytes, expected %d", layout, usable, total, mbrLimit)
+			}
+
+			if singlePartition {
+				err = FormatDiskForSinglePartition(img, useGpt, nil)
+			} else {
+				err = FormatDiskForUEFINTFS(img, useGpt, nil)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", layout, err)
+			} else if err := CheckDiskLayout(img, useGpt, singlePartition, false); err != nil {
+				t.Errorf("%s: CheckDiskLayout: %v", layout, err)
+			}
+			capacity, err := GetPrimaryPartitionCapacity(img, useGpt, singlePartition, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			disk, err := openDisk(img, diskfs.ReadOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, primarySize, err := partitionExtent(disk, 1)
+			if err != nil {
+				t.Fatalf("%s: %v", layout, err)
+			} else if primarySize != capacity {
+				t.Errorf("%s: primary partition is %d bytes, expected %d", layout, primarySize, capacity)
+			}
+			end := 1024*1024 + primarySize
+			if !singlePartition {
+				offset, size, err := partitionExtent(disk, 2)
+				if err != nil {
+					t.Fatalf("%s: %v", layout, err)
+				}
+				end = offset + size
+			}
+			disk.Close()
+			if useGpt && end < diskSize-2*1024*1024 {
+				t.Errorf("%s: partitions end at %d, expected them to span the disk", layout, end)
+			} else if !useGpt && (end > mbrLimit || end < mbrLimit-1024*1024) {
+				t.Errorf("%s: partitions end at %d, expected them to end at the MBR limit", layout, end)
+			}
+			os.Remove(img)
+		}
+	}
+}
+
+func TestFormatDiskDataPartitionTooLarge(t *testing.T) {
+	img := t.TempDir() + "/test.img"
+	if err := os.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.Truncate(img, 64*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	// Leaves less than 1 MiB for the sources partition alongside UEFI:NTFS
+	data := &DataPartition{Size: 62 * 1024 * 1024, Filesystem: "exfat", Label: "Tools"}
+	if _, err := GetPrimaryPartitionCapacity(img, false, false, data.Size); err == nil {
+		t.Error("expected GetPrimaryPartitionCapacity to fail when the data partition leaves no space")
+	} else if err := FormatDiskForUEFINTFS(img, false, data); err == nil {
+		t.Error("expected FormatDiskForUEFINTFS to fail when the data partition leaves no space")
+	}
+	if capacity, err := GetPrimaryPartitionCapacity(img, false, true, data.Size); err != nil {
+		t.Errorf("expected a 1 MiB sources partition to fit without UEFI:NTFS, got %v", err)
+	} else if capacity != 1024*1024 {
+		t.Errorf("expected a 1 MiB sources partition, got %d bytes", capacity)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+// Progress counts the bytes processed by a long-running operation, and tracks the file currently
+// being processed by it.
+type Progress struct {
+	atomic.Int64
+	file atomic.Pointer[progressFile]
+}
+
+type progressFile struct {
+	name  string
+	size  int64
+	start int64
+}
+
+// StartFile records that the file with the given path and size is now being processed.
+func (p *Progress) StartFile(name string, size int64) {
+	p.file.Store(&progressFile{name: name, size: size, start: p.Load()})
+}
+
+// ProgressUpdate is a snapshot of the progress of a long-running operation.
+type ProgressUpdate struct {
+	Action   string // Past tense verb describing the operation, e.g. "extracted"
+	Done     int64
+	Total    int64 // 0 if unknown
+	Elapsed  time.Duration
+	File     string // Slash-separated path of the file being processed, if any
+	FileDone int64
+	FileSize int64
+	Final    bool // Whether the operation has ended
+}
+
+// String formats the update as a single status line.
+func (u ProgressUpdate) String() string {
+	return imaging.FormatProgress(int(u.Done), u.Elapsed.Milliseconds(), u.Action, u.Final) +
+		formatRemaining(u.Done, u.Total, u.Elapsed.Milliseconds())
+}
+
+// ProgressFunc receives updates from long-running operations about once a second, and once more
+// when the operation ends.
+type ProgressFunc func(update ProgressUpdate)
+
+func logProgressPerSecond(ctx context.Context, logFn ProgressFunc, action string, progress *Progress, total int64) {
+	startTime := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	snapshot := func(final bool) ProgressUpdate {
+		update := ProgressUpdate{
+			Action:  action,
+			Done:    progress.Load(),
+			Total:   total,
+			Elapsed: time.Since(startTime),
+			Final:   final,
+		}
+		if file := progress.file.Load(); file != nil && !final {
+			update.File, update.FileSize = file.name, file.size
+			update.FileDone = min(update.Done-file.start, file.size)
+		}
+		return update
+	}
+	for {
+		select {
+		case <-ticker.C:
+			logFn(snapshot(false))
+		case <-ctx.Done():
+			logFn(snapshot(true))
+			return
+		}
+	}
+}
+
+// formatRemaining formats the percentage of the total processed, and an estimate of the time left
+// at the average speed so far, for appending to the output of imaging.FormatProgress.
+func formatRemaining(done, total, elapsedMs int64) string {
+	if total <= 0 {
+		return ""
+	}
+	remaining := fmt.Sprintf(", %d%%", min(done*100/total, 100))
+	if done > 0 && done < total {
+		eta := time.Duration(float64(elapsedMs)*float64(total-done)/float64(done)) * time.Millisecond
+		remaining += ", about " + eta.Round(time.Second).String() + " remaining"
+	}
+	return remaining
+}
+
+// PhaseProgress converts progress within each phase of an operation into overall progress, with
+// each phase weighted by roughly how long it takes relative to the others.
+type PhaseProgress struct {
+	weights []int64
+	total   int64
+}
+
+func NewPhaseProgress(weights []int64) *PhaseProgress {
+	progress := &PhaseProgress{weights: weights}
+	for _, weight := range weights {
+		progress.total += weight
+	}
+	return progress
+}
+
+// Percentage returns the overall percentage complete, given the fraction of the phase (counting
+// from 1) which has been completed.
+func (p *PhaseProgress) Percentage(phase int, fraction float64) int {
+	if p.total <= 0 || phase < 1 {
+		return 0
+	}
+	var done int64
+	for _, weight := range p.weights[:min(phase-1, len(p.weights))] {
+		done += weight
+	}
+	if phase <= len(p.weights) {
+		done += int64(float64(p.weights[phase-1]) * min(max(fraction, 0), 1))
+	}
+	return int(min(done*100/p.total, 100))
+}
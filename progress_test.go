@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestPhaseProgress(t *testing.T) {
+	progress := NewPhaseProgress([]int64{10, 80, 10})
+	for _, test := range []struct {
+		phase    int
+		fraction float64
+		expected int
+	}{
+		{0, 0, 0},
+		{1, 0, 0},
+		{1, 1, 10},
+		{2, 0.5, 50},
+		{3, 0, 90},
+		{3, 2, 100},
+		{4, 0, 100},
+	} {
+		if percentage := progress.Percentage(test.phase, test.fraction); percentage != test.expected {
+			t.Errorf("expected %d%% at phase %d with %v done, got %d%%",
+				test.expected, test.phase, test.fraction, percentage)
+		}
+	}
+}
+
+func TestFormatRemaining(t *testing.T) {
+	if remaining := formatRemaining(25, 100, 10000); remaining != ", 25%, about 30s remaining" {
+		t.Errorf("unexpected remaining time: %q", remaining)
+	}
+	if remaining := formatRemaining(100, 100, 10000); remaining != ", 100%" {
+		t.Errorf("unexpected remaining time when done: %q", remaining)
+	}
+	if remaining := formatRemaining(100, 0, 10000); remaining != "" {
+		t.Errorf("expected no remaining time without a total, got %q", remaining)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// reportVersion is incremented whenever fields are removed from the report or change meaning.
+const reportVersion = 1
+
+// FlashReport records what was written where by a successful flash, for audits.
+type FlashReport struct {
+	Version         int              `json:"version"`
+	GlassUSBVersion string           `json:"glassusbVersion"`
+	CompletedAt     time.Time        `json:"completedAt"`
+	ISO             ReportISO        `json:"iso"`
+	Device          ReportDevice     `json:"device"`
+	Layout          ManifestLayout   `json:"layout"`
+	Label           string           `json:"label"`
+	Phases          []PhaseTiming    `json:"phases"`
+	Validation      ReportValidation `json:"validation"`
+}
+
+type ReportISO struct {
+	Path         string        `json:"path"`
+	Size         int64         `json:"size"`
+	SHA256       string        `json:"sha256,omitempty"` // Omitted if the ISO could not be hashed
+	Label        string        `json:"label"`
+	WindowsBuild *WindowsBuild `json:"windowsBuild,omitempty"`
+}
+
+type ReportDevice struct {
+	Path   string `json:"path"`
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+}
+
+type ReportValidation struct {
+	Mode    string `json:"mode"` // none, size, sample, full or compare
+	Passed  bool   `json:"passed"`
+	Details string `json:"details,omitempty"`
+}
+
+// LoadReportKey loads a PKCS #8 private key in PEM format to sign reports with, such as an Ed25519
+// key generated with `openssl genpkey -algorithm ed25519`.
+func LoadReportKey(name string) (crypto.Signer, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("report signing key is not a PKCS #8 private key in PEM format")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse report signing key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("report signing key cannot be used for signing")
+	}
+	return signer, nil
+}
+
+// signReport signs the report as written, using Ed25519 directly, or SHA-256 with other keys.
+func signReport(data []byte, key crypto.Signer) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(data)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// WriteReport writes the report to a file. If a key is provided, a detached signature of the file
+// is written alongside it, with .sig appended to its name.
+func WriteReport(name string, report *FlashReport, key crypto.Signer) error {
+	report.Version = reportVersion
+	report.GlassUSBVersion = version
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	data = append(data, '\n')
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if key == nil {
+		return nil
+	}
+	signature, err := signReport(data, key)
+	if err != nil {
+		return fmt.Errorf("failed to sign report: %w", err)
+	} else if err := os.WriteFile(name+".sig", signature, 0644); err != nil {
+		return fmt.Errorf("failed to write report signature: %w", err)
+	}
+	return nil
+}
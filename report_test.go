@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestWriteSignedReport(t *testing.T) {
+	dir := t.TempDir()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	key, err := LoadReportKey(keyFile)
+	if err != nil {
+		t.Fatalf("failed to load key: %v", err)
+	}
+
+	reportFile := filepath.Join(dir, "report.json")
+	report := &FlashReport{
+		ISO:        ReportISO{Path: "/isos/windows.iso", SHA256: "abcd"},
+		Device:     ReportDevice{Path: "/dev/sdb", Serial: "1234"},
+		Validation: ReportValidation{Mode: "full", Passed: true},
+	}
+	if err := WriteReport(reportFile, report, key); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(reportFile)
+	signature, _ := os.ReadFile(reportFile + ".sig")
+	if !ed25519.Verify(publicKey, data, signature) {
+		t.Error("expected report signature to verify with the public key")
+	}
+	var decoded FlashReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	} else if decoded.Version != reportVersion || decoded.Device.Serial != "1234" {
+		t.Errorf("report did not round trip, got %+v", decoded)
+	}
+
+	if _, err := LoadReportKey(reportFile); err == nil {
+		t.Error("expected a file which isn't a PEM key to be rejected")
+	}
+}
+
+func TestReadWIMBuild(t *testing.T) {
+	metadata := "\ufeff<WIM><IMAGE INDEX=\"1\"><NAME>Windows 11 Home</NAME><WINDOWS><ARCH>9</ARCH>" +
+		"<VERSION><MAJOR>10</MAJOR><MINOR>0</MINOR><BUILD>22631</BUILD><SPBUILD>2861</SPBUILD></VERSION>" +
+		"</WINDOWS></IMAGE><IMAGE INDEX=\"2\"><NAME>Windows 11 Pro</NAME></IMAGE></WIM>"
+	var xmlData bytes.Buffer
+	binary.Write(&xmlData, binary.LittleEndian, utf16.Encode([]rune(metadata)))
+	header := make([]byte, wimHeaderSize)
+	copy(header, "MSWIM\x00\x00\x00")
+	binary.LittleEndian.PutUint64(header[72:], uint64(xmlData.Len()))
+	binary.LittleEndian.PutUint64(header[80:], wimHeaderSize)
+
+	build, err := readWIMBuild(bytes.NewReader(append(header, xmlData.Bytes()...)))
+	if err != nil {
+		t.Fatal(err)
+	} else if build.Version != "10.0.22631.2861" || build.Arch != "x64" || len(build.Editions) != 2 {
+		t.Errorf("unexpected Windows build %+v", build)
+	}
+	if _, err := readWIMBuild(bytes.NewReader(make([]byte, wimHeaderSize))); err == nil {
+		t.Error("expected a file which isn't a WIM to be rejected")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+const (
+	progressBarWidth   = 40
+	throughputSamples  = 40
+	plainProgressEvery = 10 * time.Second
+)
+
+var sparklineBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// ProgressRenderer displays progress on a terminal. When the output is a terminal, the current
+// phase, overall progress, the file being processed and a throughput graph are redrawn in place
+// below any log output. Otherwise, progress is printed as plain log lines every few seconds.
+//
+// ProgressRenderer is an io.Writer, so that log output can be routed through it without clobbering
+// the progress display.
+type ProgressRenderer struct {
+	mutex sync.Mutex
+	out   *os.File
+	tty   bool
+	lines int // Number of lines drawn by the last render
+
+	phase     string
+	overall   int // -1 if unknown
+	started   time.Time
+	update    *ProgressUpdate
+	samples   []float64
+	lastDone  int64
+	lastTime  time.Duration
+	lastPrint time.Time
+}
+
+func NewProgressRenderer(out *os.File) *ProgressRenderer {
+	tty := false
+	if stat, err := out.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		tty = os.Getenv("TERM") != "dumb"
+	}
+	return &ProgressRenderer{out: out, tty: tty, overall: -1}
+}
+
+// Write prints log output above the progress display.
+func (r *ProgressRenderer) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clear()
+	n, err := r.out.Write(p)
+	r.render()
+	return n, err
+}
+
+// SetPhase sets the phase shown above the overall progress bar.
+func (r *ProgressRenderer) SetPhase(phase string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.phase = phase
+	r.update = nil
+	r.redraw()
+}
+
+// SetOverall sets the overall progress percentage across all phases.
+func (r *ProgressRenderer) SetOverall(percentage int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.overall < 0 {
+		r.started = time.Now()
+	}
+	r.overall = percentage
+	r.redraw()
+}
+
+// Update is a ProgressFunc which displays the progress of the current operation.
+func (r *ProgressRenderer) Update(update ProgressUpdate) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.update == nil || r.update.Action != update.Action || update.Done < r.lastDone {
+		r.samples, r.lastDone, r.lastTime = nil, 0, 0
+	}
+	if interval := update.Elapsed - r.lastTime; interval > 0 {
+		r.samples = append(r.samples, float64(update.Done-r.lastDone)/interval.Seconds())
+		if len(r.samples) > throughputSamples {
+			r.samples = r.samples[len(r.samples)-throughputSamples:]
+		}
+	}
+	r.lastDone, r.lastTime = update.Done, update.Elapsed
+
+	if !r.tty {
+		if update.Final || time.Since(r.lastPrint) >= plainProgressEvery {
+			r.lastPrint = time.Now()
+			fmt.Fprintln(r.out, update.String())
+		}
+		r.update = &update
+		return
+	}
+	r.clear()
+	if update.Final {
+		fmt.Fprintln(r.out, update.String())
+		r.update = nil
+	} else {
+		r.update = &update
+	}
+	r.render()
+}
+
+// Close clears the progress display, leaving only log output on the terminal.
+func (r *ProgressRenderer) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clear()
+	r.phase, r.update = "", nil
+}
+
+func (r *ProgressRenderer) redraw() {
+	r.clear()
+	r.render()
+}
+
+// clear erases the lines drawn by the last render, and moves the cursor back to where it began.
+func (r *ProgressRenderer) clear() {
+	if r.tty && r.lines > 0 {
+		fmt.Fprintf(r.out, "\x1b[%dF\x1b[J", r.lines)
+		r.lines = 0
+	}
+}
+
+func (r *ProgressRenderer) render() {
+	if !r.tty || r.phase == "" {
+		return
+	}
+	lines := []string{r.phase}
+	if r.overall >= 0 {
+		overall := renderProgressBar(float64(r.overall)/100) + fmt.Sprintf(" %3d%% overall", r.overall)
+		if elapsed := time.Since(r.started); r.overall > 0 && r.overall < 100 {
+			eta := time.Duration(float64(elapsed) * float64(100-r.overall) / float64(r.overall))
+			overall += ", about " + eta.Round(time.Second).String() + " remaining"
+		}
+		lines = append(lines, overall)
+	}
+	if update := r.update; update != nil {
+		if update.File != "" {
+			lines = append(lines, "  "+truncateFilePath(update.File, progressBarWidth+10)+
+				" ("+imaging.BytesToString(int(update.FileSize), false)+")")
+			fraction := 1.0
+			if update.FileSize > 0 {
+				fraction = float64(update.FileDone) / float64(update.FileSize)
+			}
+			lines = append(lines, "  "+renderProgressBar(fraction)+fmt.Sprintf(" %3d%%", int(fraction*100)))
+		}
+		lines = append(lines, "  "+update.String())
+		if len(r.samples) > 0 {
+			lines = append(lines, "  "+renderSparkline(r.samples)+" "+
+				imaging.BytesToString(int(r.samples[len(r.samples)-1]), false)+"/s")
+		}
+	}
+	width := getTerminalWidth(r.out)
+	for _, line := range lines {
+		// Lines wrapping onto the next would throw off clearing the display
+		if runes := []rune(line); width > 0 && len(runes) >= width {
+			line = string(runes[:width-1])
+		}
+		fmt.Fprintln(r.out, line)
+	}
+	r.lines = len(lines)
+}
+
+func renderProgressBar(fraction float64) string {
+	filled := int(min(max(fraction, 0), 1) * progressBarWidth)
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled) + "]"
+}
+
+// renderSparkline draws a graph of the given throughput samples, scaled to the highest sample.
+func renderSparkline(samples []float64) string {
+	var peak float64
+	for _, sample := range samples {
+		peak = max(peak, sample)
+	}
+	graph := make([]rune, throughputSamples)
+	for index := range graph {
+		graph[index] = ' '
+	}
+	offset := throughputSamples - len(samples)
+	for index, sample := range samples {
+		level := 0
+		if peak > 0 {
+			level = int(sample / peak * float64(len(sparklineBlocks)-1))
+		}
+		graph[offset+index] = sparklineBlocks[level]
+	}
+	return string(graph)
+}
+
+// truncateFilePath shortens a path to the given number of characters, keeping the end of it.
+func truncateFilePath(name string, length int) string {
+	runes := []rune(name)
+	if len(runes) <= length {
+		return name
+	}
+	return "…" + string(runes[len(runes)-length+1:])
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+func getTerminalWidth(file *os.File) int {
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRenderSparkline(t *testing.T) {
+	graph := []rune(renderSparkline([]float64{0, 50, 100}))
+	if len(graph) != throughputSamples {
+		t.Fatalf("expected graph of %d characters, got %d", throughputSamples, len(graph))
+	} else if string(graph[throughputSamples-3:]) != "▁▄█" {
+		t.Errorf("unexpected graph: %q", string(graph))
+	} else if strings.TrimSpace(string(graph[:throughputSamples-3])) != "" {
+		t.Errorf("expected graph to be padded on the left: %q", string(graph))
+	}
+}
+
+func TestProgressRendererPlain(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	renderer := NewProgressRenderer(file)
+	renderer.SetPhase("Phase 1/1: Testing")
+	renderer.SetOverall(50)
+	renderer.Write([]byte("log line\n"))
+	renderer.Update(ProgressUpdate{Action: "tested", Done: 1, Total: 2})
+	renderer.Update(ProgressUpdate{Action: "tested", Done: 2, Total: 2})
+	renderer.Update(ProgressUpdate{Action: "tested", Done: 2, Total: 2, Final: true})
+	renderer.Close()
+
+	output, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+	// Only the log line, the first update and the final update should be printed
+	if len(lines) != 3 || lines[0] != "log line" || strings.Contains(string(output), "\x1b") {
+		t.Errorf("unexpected output when not a terminal: %q", output)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+var updateFlagSet = flag.NewFlagSet("update", flag.ExitOnError)
+
+func init() {
+	updateFlagSet.BoolVar(skipValidationFlag, "skip-validation", false,
+		"Skip validation of written files")
+	updateFlagSet.StringVar(verifyFlag, "verify", "full",
+		"Method used to validate written files.\n"+
+			"\nnone: Skip validation, same as -skip-validation.\n"+
+			"size: Only check that all files and folders exist with the expected sizes.\n"+
+			"sample: Compare the start, end and 8 random 1 MiB chunks of every file against the ISO.\n"+
+			"full: Compare files on the USB drive against hashes computed during the update.\n"+
+			"compare: Compare files on the USB drive byte-by-byte against the ISO (slower).\n"+
+			"hash: Alias for full.\n"+
+			"\nAvailable options: none, size, sample, full, compare, hash")
+	updateFlagSet.StringVar(ioniceFlag, "ionice", "",
+		"I/O scheduling class to run with, so that updating doesn't slow down other programs.\n"+
+			"\nAvailable options: idle, best-effort")
+	updateFlagSet.Var(&overlayFlag, "overlay",
+		"Folder whose contents are copied onto the USB drive after the ISO is updated.\n"+
+			"Can be specified multiple times. Files in the overlay replace files in the ISO.\n"+
+			"Files from a previous overlay which are not in any overlay are deleted.")
+	updateFlagSet.Var(&excludeFlag, "exclude",
+		"Glob pattern for files and folders in the ISO which should not be written. Excluded\n"+
+			"files already on the USB drive are deleted. Can be specified multiple times.")
+	updateFlagSet.StringVar(progressFlag, "progress", "text",
+		"Format to report progress in.\n"+
+			"\ntext: Human-readable progress on the terminal.\n"+
+			"json: Newline-delimited JSON events (documented in the README), written to the file\n"+
+			"descriptor given by -progress-fd. Human-readable progress is still logged to stderr.\n"+
+			"\nAvailable options: text, json")
+	updateFlagSet.IntVar(progressFdFlag, "progress-fd", 1,
+		"File descriptor to write JSON progress events to, stdout by default")
+	updateFlagSet.BoolVar(hashISOFlag, "hash-iso", false,
+		"Hash the whole ISO while updating, to record its SHA-256 hash in the manifest.\n"+
+			"This reads the ISO a second time alongside the update.")
+	updateFlagSet.Usage = updateUsage
+}
+
+func updateUsage() {
+	println("Usage: glassUSB update [options] <disk image file> <device path>")
+	println("\nUpdate a USB drive previously flashed by glassUSB to a newer Windows ISO, only")
+	println("copying files which have changed, and deleting files which are no longer present.")
+	println("\nOptions:")
+	updateFlagSet.PrintDefaults()
+}
+
+func updateCommand() (err error) {
+	log.SetFlags(0)
+	renderer := NewProgressRenderer(os.Stderr)
+	defer renderer.Close()
+	log.SetOutput(renderer)
+	log.SetPrefix("[glassUSB] ")
+	logProgress := func(message string) {
+		renderer.SetPhase(message)
+		log.Println(message)
+	}
+
+	updateFlagSet.Parse(os.Args[2:])
+	args := updateFlagSet.Args()
+	if len(args) != 2 {
+		updateFlagSet.Usage()
+		os.Exit(1)
+	} else if _, _, err := ParseValidationMode(*verifyFlag, *skipValidationFlag); err != nil {
+		log.Println("Invalid value provided for `-verify` flag!")
+		updateFlagSet.Usage()
+		os.Exit(1)
+	} else if *ioniceFlag != "" && *ioniceFlag != "idle" && *ioniceFlag != "best-effort" {
+		log.Println("Invalid value provided for `-ionice` flag!")
+		updateFlagSet.Usage()
+		os.Exit(1)
+	} else if (*progressFlag != "text" && *progressFlag != "json") || *progressFdFlag < 0 {
+		log.Println("Invalid value provided for `-progress` or `-progress-fd` flag!")
+		updateFlagSet.Usage()
+		os.Exit(1)
+	}
+	validationMode, compareWithISO, _ := ParseValidationMode(*verifyFlag, *skipValidationFlag)
+	*skipValidationFlag = validationMode == ValidationNone
+	ctx := context.Background()
+	events := NewEventWriter(OpenEventOutput(*progressFlag, *progressFdFlag))
+	events.Start("update")
+	errorCode := ErrorCodeInvalidOptions
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			events.Result(err, ErrorCodeCancelled)
+		} else {
+			events.Result(err, errorCode)
+		}
+	}()
+	exclude, err := ParseExcludePatterns(excludeFlag)
+	if err != nil {
+		return err
+	}
+	debugBypassChecksEnv := os.Getenv("__GLASSUSB_DEBUG_BYPASS_CHECKS")
+	debugBypassChecks := debugBypassChecksEnv == "true" || debugBypassChecksEnv == "1"
+	if os.Getuid() > 0 && !debugBypassChecks {
+		errorCode = ErrorCodePermissionDenied
+		return fmt.Errorf("glassUSB must be run with root permissions (`sudo`) to write to devices, exiting...")
+	}
+	if *ioniceFlag != "" {
+		if err := SetIOPriorityClass(*ioniceFlag); err != nil {
+			log.Printf("Warning: Failed to set I/O scheduling class to %s: %v", *ioniceFlag, err)
+			events.Warning(fmt.Sprintf("Failed to set I/O scheduling class to %s: %v", *ioniceFlag, err))
+		}
+	}
+	log.Println("Selected ISO:", args[0])
+	log.Println("Target device path:", args[1])
+
+	totalPhasesNum := 4
+	if *skipValidationFlag {
+		totalPhasesNum-- // Skip validation phase
+	}
+	totalPhases := strconv.Itoa(totalPhasesNum)
+	currentPhase, currentPhaseID := 0, ""
+	progressFn := func(update ProgressUpdate) {
+		renderer.Update(update)
+		events.Progress(update)
+	}
+	startPhase := func(id, name string) {
+		currentPhase++
+		currentPhaseID = id
+		events.StartPhase(currentPhase, totalPhasesNum, id, name)
+		logProgress("Phase " + strconv.Itoa(currentPhase) + "/" + totalPhases + ": " + name)
+	}
+	errorCode = "" // Errors from here on are reported as failures of the current phase
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer cancel()
+
+	// Step 1: Read ISO
+	startPhase("reading", "Reading ISO")
+	file, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open ISO: %w", err)
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat ISO file: %w", err)
+	}
+	iso, err := OpenWindowsISO(file)
+	if err != nil {
+		return fmt.Errorf("failed to read UDF filesystem on ISO: %w", err)
+	}
+	var isoHasher *BackgroundHash
+	if *hashISOFlag {
+		isoHasher = HashFileInBackground(ctx, file)
+	}
+	var overlay Overlay
+	if len(overlayFlag) > 0 {
+		overlay, err = LoadOverlay(overlayFlag)
+		if err != nil {
+			return fmt.Errorf("failed to load overlay: %w", err)
+		}
+		var conflicts []string
+		overlay, conflicts, err = ResolveOverlayConflicts(iso, overlay)
+		if err != nil {
+			return fmt.Errorf("cannot apply overlay: %w", err)
+		} else if len(conflicts) > 0 {
+			log.Printf("Warning: The following files in the ISO will be replaced by files from the overlay:\n%s",
+				strings.Join(conflicts, "\n"))
+			events.Warning("The following files in the ISO will be replaced by files from the overlay:\n" +
+				strings.Join(conflicts, "\n"))
+		}
+	}
+	blockDevice := args[1]
+	err = imaging.UnmountDevice(blockDevice)
+	if err != nil && err != imaging.ErrNotBlockDevice { // Ignore non-block-device error here
+		return fmt.Errorf("failed to unmount destination device: %w", err)
+	}
+	// Files which aren't in the ISO are deleted, so refuse drives which glassUSB didn't partition
+	errorCode = ErrorCodeInvalidDevice
+	results, layout, primaryPartition := checkDrivePartitions(blockDevice)
+	if layout == nil {
+		logCheckResults(results)
+		return fmt.Errorf("destination was not flashed by glassUSB, refusing to update it")
+	}
+	filesystem := layout.Filesystem
+	partitionSize, err := GetBlockDeviceSize(primaryPartition)
+	if err != nil {
+		return fmt.Errorf("failed to get size of sources partition: %w", err)
+	}
+	// Check the new contents fit before any files are deleted, rather than leaving the drive half-updated
+	errorCode = ErrorCodeIncompatible
+	if problems := AnalyzeContents(iso, exclude, overlay).CheckCompatibility(filesystem, partitionSize); len(problems) > 0 {
+		return fmt.Errorf("cannot update destination with %s:\n%s",
+			getFilesystemName(filesystem), FormatCompatibilityProblems(problems))
+	}
+	errorCode = ""
+
+	// Record every update in the history ledger, whether it succeeds or not
+	deviceModel, deviceSerial, err := GetDeviceIdentity(blockDevice)
+	if err != nil {
+		log.Printf("Warning: Failed to identify destination drive, its model and serial will not be recorded: %v", err)
+	}
+	isoPath, err := filepath.Abs(args[0])
+	if err != nil {
+		isoPath = args[0]
+	}
+	updateStarted := time.Now()
+	defer func() {
+		entry := HistoryEntry{
+			Time:       updateStarted.UTC(),
+			Command:    "update",
+			Operator:   GetOperator(),
+			Version:    version,
+			ISOPath:    isoPath,
+			ISOLabel:   iso.GetLogicalVolumeIdentifier(),
+			Device:     blockDevice,
+			Model:      deviceModel,
+			Serial:     deviceSerial,
+			Outcome:    HistoryOutcomeSuccess,
+			DurationMs: time.Since(updateStarted).Milliseconds(),
+		}
+		if err != nil && ctx.Err() != nil {
+			entry.Outcome, entry.ErrorCode = HistoryOutcomeCancelled, ErrorCodeCancelled
+		} else if err != nil {
+			entry.Outcome, entry.ErrorCode = HistoryOutcomeFailed, currentPhaseID+"_failed"
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		// Don't hold up reporting a failure until the whole ISO has been read
+		entry.ISOSHA256 = hex.EncodeToString(isoHasher.Finished())
+		if err := AppendHistory(GetHistoryFile(), entry); err != nil {
+			log.Printf("Warning: Failed to record update in history: %v", err)
+		}
+	}()
+	if ctx.Err() != nil {
+		return fmt.Errorf("operation cancelled")
+	}
+
+	// Step 2: Update files on primary partition
+	var hashes FileHashes
+	if err = func() error {
+		startPhase("update", "Updating files on sources partition")
+		mountPoint, err := os.MkdirTemp(os.TempDir(), "glassusb-")
+		if err != nil {
+			return fmt.Errorf("failed to create mount point: %w", err)
+		}
+		defer os.Remove(mountPoint)
+		if err := MountPartition(primaryPartition, mountPoint); err != nil {
+			return fmt.Errorf("failed to mount partition: %w", err)
+		}
+		defer func() {
+			if err := UnmountPartition(mountPoint); err != nil {
+				log.Printf("Failed to unmount partition: %v", err)
+			}
+		}()
+		hashes, err = UpdateLocationFromISO(ctx, progressFn, iso, mountPoint, exclude, overlay)
+		if err != nil {
+			return fmt.Errorf("failed to update ISO contents: %w", err)
+		}
+		if len(overlay) > 0 {
+			log.Println("Copying overlay files to sources partition")
+			if err := CopyOverlayToLocation(ctx, progressFn, overlay, mountPoint, hashes); err != nil {
+				return fmt.Errorf("failed to copy overlay: %w", err)
+			}
+		}
+		isoHash, err := isoHasher.Wait()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: Failed to hash ISO, its hash will not be recorded in the manifest: %v", err)
+			events.Warning(fmt.Sprintf("Failed to hash ISO, its hash will not be recorded in the manifest: %v", err))
+		}
+		manifest, err := NewManifest(AnalyzeContents(iso, exclude, overlay), hashes, ManifestISO{
+			Name:   filepath.Base(args[0]),
+			Size:   stat.Size(),
+			Label:  iso.GetLogicalVolumeIdentifier(),
+			SHA256: hex.EncodeToString(isoHash),
+		}, *layout)
+		if err != nil {
+			return fmt.Errorf("failed to create manifest: %w", err)
+		}
+		manifest.Exclude, manifest.Overlay = exclude, len(overlay) > 0
+		return WriteManifest(mountPoint, manifest)
+	}(); err != nil {
+		return err
+	}
+
+	// Step 3: Validate Windows ISO contents on primary partition
+	if err = func() error {
+		if *skipValidationFlag {
+			return nil
+		}
+		startPhase("validation", "Validating ISO contents on sources partition")
+		cacheFlushed := true
+		if err := FlushBlockDeviceCache(primaryPartition); err != nil {
+			log.Printf("Failed to flush cache for %s, validation may read from memory: %v", primaryPartition, err)
+			cacheFlushed = false
+		}
+		mountPoint, err := os.MkdirTemp(os.TempDir(), "glassusb-")
+		if err != nil {
+			return fmt.Errorf("failed to create mount point: %w", err)
+		}
+		defer os.Remove(mountPoint)
+		if err := MountPartition(primaryPartition, mountPoint); err != nil {
+			return fmt.Errorf("failed to mount partition: %w", err)
+		}
+		defer func() {
+			if err := UnmountPartition(mountPoint); err != nil {
+				log.Printf("Failed to unmount partition: %v", err)
+			}
+		}()
+		if compareWithISO {
+			hashes = nil // Compare against the ISO itself instead of the hashes
+		}
+		guarantee, err := ValidateISOAgainstLocation(ctx, progressFn, iso, mountPoint, exclude, validationMode, hashes, overlay)
+		if err != nil {
+			return fmt.Errorf("failed to validate ISO contents: %w", err)
+		}
+		if !cacheFlushed {
+			guarantee = ReadGuaranteeNone
+		}
+		if validationMode == ValidationSize {
+			log.Println("Validation succeeded: all files exist with the expected sizes, their contents were not read")
+		} else {
+			log.Println("Validation succeeded: " + guarantee.String())
+		}
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	// Step 4: Update volume label
+	startPhase("label", "Updating volume label")
+	windowsVolumeLabel := iso.GetLogicalVolumeIdentifier()
+	if windowsVolumeLabel == "" {
+		windowsVolumeLabel = "Windows USB"
+	}
+	if err := SetFilesystemLabel(primaryPartition, filesystem, windowsVolumeLabel); err != nil {
+		return fmt.Errorf("failed to update volume label: %w", err)
+	}
+	signal.Reset(os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	log.Println("The update completed successfully! You can now boot from this USB to install Windows.")
+	return nil
+}
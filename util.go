@@ -11,6 +11,17 @@ func truncateString(s string, maxLength int) string {
 	return s[:maxLength]
 }
 
+// sanitizeLabel ensures the label is valid for the given filesystem.
+func sanitizeLabel(filesystem string, label string) string {
+	switch filesystem {
+	case "ntfs":
+		return sanitizeNTFSLabel(label)
+	case "exfat":
+		return sanitizeExFATLabel(label)
+	}
+	return sanitizeFATLabel(label)
+}
+
 // sanitizeNTFSLabel ensures the label is valid for NTFS filesystems.
 func sanitizeNTFSLabel(label string) string {
 	// Yeah, this could be a lot more efficient, but who cares
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+)
+
+// ValidationMode selects how thoroughly files written to the USB drive are validated.
+type ValidationMode string
+
+const (
+	// ValidationNone skips validation entirely.
+	ValidationNone ValidationMode = "none"
+	// ValidationSize checks that the tree structure and file sizes match, without reading files.
+	ValidationSize ValidationMode = "size"
+	// ValidationSample compares the head, tail and randomly chosen chunks of every file.
+	ValidationSample ValidationMode = "sample"
+	// ValidationFull reads every file back in full, comparing it against hashes if available.
+	ValidationFull ValidationMode = "full"
+)
+
+const (
+	// sampleChunkSize is the size of each chunk compared by ValidationSample. Chunks are aligned to
+	// their size, which satisfies the alignment required by O_DIRECT.
+	sampleChunkSize = 1024 * 1024
+	// sampleChunksPerFile is the number of randomly chosen chunks compared in each file, in addition
+	// to its first and last chunk.
+	sampleChunksPerFile = 8
+)
+
+// ParseValidationMode parses the -verify flag. "full" (or its alias "hash") selects ValidationFull
+// with files compared against the hashes computed while writing them, while "compare" selects
+// ValidationFull with files compared byte-by-byte against the ISO. -skip-validation is treated as
+// "none".
+func ParseValidationMode(verify string, skipValidation bool) (mode ValidationMode, compare bool, err error) {
+	switch {
+	case skipValidation:
+		return ValidationNone, false, nil
+	case verify == string(ValidationFull) || verify == "hash":
+		return ValidationFull, false, nil
+	case verify == "compare":
+		return ValidationFull, true, nil
+	case slices.Contains([]ValidationMode{ValidationNone, ValidationSize, ValidationSample}, ValidationMode(verify)):
+		return ValidationMode(verify), false, nil
+	}
+	return "", false, errors.New("invalid validation mode " + verify)
+}
+
+// validationReadSize returns the number of bytes of a file of the given size which are read when
+// validating it with the given mode.
+func validationReadSize(mode ValidationMode, size int64) int64 {
+	switch mode {
+	case ValidationNone, ValidationSize:
+		return 0
+	case ValidationSample:
+		return min(size, (sampleChunksPerFile+2)*sampleChunkSize)
+	}
+	return size
+}
+
+// ValidationReadSize returns the number of bytes read from the USB drive when validating the
+// contents with the given mode.
+func (a *ContentAnalysis) ValidationReadSize(mode ValidationMode) int64 {
+	var total int64
+	for _, entry := range a.Entries {
+		total += validationReadSize(mode, entry.Size)
+	}
+	return total
+}
+
+// validateFileSize checks that a file exists with the expected size, without reading it.
+func validateFileSize(name string, expectedSize int64, progress *Progress) error {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", name, err)
+	} else if stat.IsDir() {
+		return fmt.Errorf("%s is a directory, expected a file", name)
+	} else if stat.Size() != expectedSize {
+		return fmt.Errorf("file %s on disk is %d bytes, expected %d bytes", name, stat.Size(), expectedSize)
+	}
+	progress.Add(validationReadSize(ValidationSize, expectedSize))
+	return nil
+}
+
+// sampleChunks picks the chunks of a file of the given size which are compared by
+// ValidationSample: the first and last chunk, and sampleChunksPerFile chunks chosen at random.
+func sampleChunks(size int64) []int64 {
+	count := (size + sampleChunkSize - 1) / sampleChunkSize
+	if count <= sampleChunksPerFile+2 {
+		chunks := make([]int64, count)
+		for i := range chunks {
+			chunks[i] = int64(i)
+		}
+		return chunks
+	}
+	chunks := []int64{0, count - 1}
+	for len(chunks) < sampleChunksPerFile+2 {
+		if chunk := 1 + rand.Int64N(count-2); !slices.Contains(chunks, chunk) {
+			chunks = append(chunks, chunk)
+		}
+	}
+	slices.Sort(chunks)
+	return chunks
+}
+
+// validateFileSamples compares the chunks of a file picked by sampleChunks against its source.
+func validateFileSamples(ctx context.Context, src io.ReaderAt, name string, expectedSize int64, progress *Progress, guarantee *ReadGuarantee) error {
+	destFile, fileGuarantee, err := OpenUncached(name)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", name, err)
+	}
+	defer destFile.Close()
+	*guarantee = min(*guarantee, fileGuarantee)
+	if stat, err := destFile.Stat(); err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", name, err)
+	} else if stat.Size() != expectedSize {
+		return fmt.Errorf("file %s on disk is %d bytes, expected %d bytes", name, stat.Size(), expectedSize)
+	}
+	srcBuf := make([]byte, sampleChunkSize)
+	destBuf := newUncachedBuffer(sampleChunkSize, fileGuarantee)
+	for _, chunk := range sampleChunks(expectedSize) {
+		if ctx.Err() != nil {
+			return fmt.Errorf("operation cancelled")
+		}
+		offset := chunk * sampleChunkSize
+		length := int(min(sampleChunkSize, expectedSize-offset))
+		// The last chunk is read in full with O_DIRECT, and comes back short at the end of the file
+		if n, err := destFile.ReadAt(destBuf, offset); n < length {
+			return fmt.Errorf("failed to read file %s from destination at offset %d: %w", name, offset, err)
+		}
+		if n, err := src.ReadAt(srcBuf[:length], offset); n < length {
+			return fmt.Errorf("failed to read file %s from source at offset %d: %w", name, offset, err)
+		}
+		if !bytes.Equal(srcBuf[:length], destBuf[:length]) {
+			return fmt.Errorf("contents of file %s at offset %d do not match the source", name, offset)
+		}
+		progress.Add(int64(length))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseValidationMode(t *testing.T) {
+	if mode, compare, err := ParseValidationMode("full", false); mode != ValidationFull || compare || err != nil {
+		t.Errorf("expected full to select full validation against hashes, got %s, %v, %v", mode, compare, err)
+	}
+	if mode, compare, err := ParseValidationMode("hash", false); mode != ValidationFull || compare || err != nil {
+		t.Errorf("expected hash to be an alias for full, got %s, %v, %v", mode, compare, err)
+	}
+	if mode, compare, err := ParseValidationMode("compare", false); mode != ValidationFull || !compare || err != nil {
+		t.Errorf("expected compare to select full validation against the ISO, got %s, %v, %v", mode, compare, err)
+	}
+	if mode, _, err := ParseValidationMode("full", true); mode != ValidationNone || err != nil {
+		t.Errorf("expected -skip-validation to select no validation, got %s, %v", mode, err)
+	}
+	if mode, _, err := ParseValidationMode("sample", false); mode != ValidationSample || err != nil {
+		t.Errorf("expected sample validation, got %s, %v", mode, err)
+	}
+	if _, _, err := ParseValidationMode("quick", false); err == nil {
+		t.Error("expected invalid validation mode to be rejected")
+	}
+}
+
+func TestSampleChunks(t *testing.T) {
+	if chunks := sampleChunks(3*sampleChunkSize + 1); !slices.Equal(chunks, []int64{0, 1, 2, 3}) {
+		t.Errorf("expected every chunk of a small file to be sampled, got %v", chunks)
+	}
+	chunks := sampleChunks(100*sampleChunkSize + 1)
+	if len(chunks) != sampleChunksPerFile+2 || chunks[0] != 0 || chunks[len(chunks)-1] != 100 {
+		t.Errorf("expected first, last and %d random chunks, got %v", sampleChunksPerFile, chunks)
+	} else if len(slices.Compact(slices.Clone(chunks))) != len(chunks) {
+		t.Errorf("expected sampled chunks to be distinct, got %v", chunks)
+	}
+}
+
+func TestValidateFileSamples(t *testing.T) {
+	data := bytes.Repeat([]byte("glassUSB"), (20*sampleChunkSize+123)/8)
+	name := filepath.Join(t.TempDir(), "install.wim")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	guarantee := ReadGuaranteeDirect
+	if err := validateFileSamples(context.Background(), bytes.NewReader(data), name, int64(len(data)), &Progress{}, &guarantee); err != nil {
+		t.Errorf("expected identical file to validate, got %v", err)
+	}
+	if err := validateFileSize(name, int64(len(data)), &Progress{}); err != nil {
+		t.Errorf("expected file size to validate, got %v", err)
+	}
+
+	// Corruption at the very end of the file is always sampled
+	corrupted := slices.Clone(data)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if err := validateFileSamples(context.Background(), bytes.NewReader(corrupted), name, int64(len(data)), &Progress{}, &guarantee); err == nil {
+		t.Error("expected corrupted tail to fail validation")
+	}
+	if err := validateFileSize(name, int64(len(data))+1, &Progress{}); err == nil {
+		t.Error("expected mismatched size to fail validation")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/retrixe/imprint/imaging"
+	"github.com/retrixe/udf"
+)
+
+var verifyCommandFlagSet = flag.NewFlagSet("verify", flag.ExitOnError)
+
+func init() {
+	verifyCommandFlagSet.Var(&overlayFlag, "overlay",
+		"Folder whose contents were copied onto the USB drive when it was flashed.\n"+
+			"Can be specified multiple times.")
+	verifyCommandFlagSet.Var(&excludeFlag, "exclude",
+		"Glob pattern for files and folders in the ISO which were not written when the USB\n"+
+			"drive was flashed. Can be specified multiple times.")
+	verifyCommandFlagSet.Usage = verifyUsage
+}
+
+func verifyUsage() {
+	println("Usage: glassUSB verify [options] [<disk image file>] <device path>")
+	println("\nCheck a USB drive previously flashed by glassUSB, without writing anything to it.")
+	println("The partition layout, the UEFI:NTFS partition and the files on the drive are checked.")
+	println("\nIf a Windows ISO is given, the files are checked against it. Otherwise, they are")
+	println("checked against the manifest (" + manifestFileName + ") which glassUSB writes to the drive when")
+	println("flashing it.")
+	println("\nOptions:")
+	verifyCommandFlagSet.PrintDefaults()
+}
+
+// CheckResult is the outcome of a single check of a drive.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Details string `json:"details,omitempty"`
+}
+
+func newCheckResult(name string, err error, details string) CheckResult {
+	if err != nil {
+		return CheckResult{Name: name, Passed: false, Details: imaging.CapitalizeString(err.Error())}
+	}
+	return CheckResult{Name: name, Passed: true, Details: details}
+}
+
+// logCheckResults logs a pass/fail report of the given checks, returning the number which failed.
+func logCheckResults(results []CheckResult) int {
+	failed := 0
+	for _, result := range results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+			failed++
+		}
+		if result.Details == "" {
+			log.Printf("  [%s] %s", status, result.Name)
+		} else {
+			log.Printf("  [%s] %s: %s", status, result.Name,
+				strings.ReplaceAll(result.Details, "\n", "\n         "))
+		}
+	}
+	return failed
+}
+
+func describeDiskLayout(useGpt bool, singlePartition bool, dataPartition bool) string {
+	table := "MBR"
+	if useGpt {
+		table = "GPT"
+	}
+	layout := table + " with a sources partition and a UEFI:NTFS partition"
+	if singlePartition {
+		layout = table + " with a single FAT32 partition"
+	}
+	if dataPartition {
+		layout += ", followed by a data partition"
+	}
+	return layout
+}
+
+func verifyCommand() error {
+	log.SetFlags(0)
+	renderer := NewProgressRenderer(os.Stderr)
+	defer renderer.Close()
+	log.SetOutput(renderer)
+	log.SetPrefix("[glassUSB] ")
+
+	verifyCommandFlagSet.Parse(os.Args[2:])
+	args := verifyCommandFlagSet.Args()
+	if len(args) != 1 && len(args) != 2 {
+		verifyCommandFlagSet.Usage()
+		os.Exit(1)
+	}
+	exclude, err := ParseExcludePatterns(excludeFlag)
+	if err != nil {
+		return err
+	}
+	debugBypassChecksEnv := os.Getenv("__GLASSUSB_DEBUG_BYPASS_CHECKS")
+	debugBypassChecks := debugBypassChecksEnv == "true" || debugBypassChecksEnv == "1"
+	if os.Getuid() > 0 && !debugBypassChecks {
+		return fmt.Errorf("glassUSB must be run with root permissions (`sudo`) to read devices, exiting...")
+	}
+	blockDevice := args[len(args)-1]
+	if len(args) == 2 {
+		log.Println("Selected ISO:", args[0])
+	}
+	log.Println("Target device path:", blockDevice)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer cancel()
+
+	var iso *udf.Udf
+	var overlay Overlay
+	if len(args) == 2 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open ISO: %w", err)
+		}
+		defer file.Close()
+		iso, err = OpenWindowsISO(file)
+		if err != nil {
+			return fmt.Errorf("failed to read UDF filesystem on ISO: %w", err)
+		}
+		if len(overlayFlag) > 0 {
+			overlay, err = LoadOverlay(overlayFlag)
+			if err != nil {
+				return fmt.Errorf("failed to load overlay: %w", err)
+			}
+			if overlay, _, err = ResolveOverlayConflicts(iso, overlay); err != nil {
+				return fmt.Errorf("cannot apply overlay: %w", err)
+			}
+		}
+	} else if len(overlayFlag) > 0 || len(exclude) > 0 {
+		return fmt.Errorf("-overlay and -exclude can only be used when verifying against an ISO")
+	}
+	err = imaging.UnmountDevice(blockDevice)
+	if err != nil && err != imaging.ErrNotBlockDevice { // Ignore non-block-device error here
+		return fmt.Errorf("failed to unmount destination device: %w", err)
+	}
+
+	var results []CheckResult
+	if iso != nil {
+		results = VerifyDriveAgainstISO(ctx, renderer, iso, blockDevice, exclude, overlay)
+	} else {
+		results = VerifyDriveAgainstManifest(ctx, renderer, blockDevice)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("operation cancelled")
+	}
+	log.Println("Verification report for " + blockDevice + ":")
+	if failed := logCheckResults(results); failed > 0 {
+		return fmt.Errorf("verification failed, %d of %d checks did not pass", failed, len(results))
+	} else if iso != nil {
+		log.Println("Verification passed! This USB drive matches the ISO.")
+	} else {
+		log.Println("Verification passed! This USB drive matches its manifest.")
+	}
+	return nil
+}
+
+// checkDrivePartitions checks the partition layout, the UEFI:NTFS partition and the filesystem on
+// the sources partition of a drive, returning the detected layout and the device node of the
+// sources partition if every check passed.
+func checkDrivePartitions(blockDevice string) ([]CheckResult, *ManifestLayout, string) {
+	results := []CheckResult{}
+	useGpt, singlePartition, dataPartition, err := DetectDiskLayout(blockDevice)
+	if err != nil {
+		return append(results, newCheckResult("Partition layout", err, "")), nil, ""
+	}
+	err = CheckDiskLayout(blockDevice, useGpt, singlePartition, dataPartition)
+	results = append(results, newCheckResult("Partition layout", err,
+		describeDiskLayout(useGpt, singlePartition, dataPartition)))
+	if !singlePartition {
+		results = append(results, newCheckResult("UEFI:NTFS partition", CheckUEFINTFSPartition(blockDevice, 2), ""))
+	}
+
+	var filesystem string
+	primaryPartition, err := GetBlockDevicePartition(blockDevice, 1)
+	if err == nil {
+		filesystem, err = DetectFilesystem(primaryPartition)
+	}
+	if err == nil && singlePartition && filesystem != "fat32" {
+		err = fmt.Errorf("expected FAT32 on a single partition drive, found %s", getFilesystemName(filesystem))
+	} else if err == nil && !singlePartition && !slices.Contains([]string{"ntfs", "exfat"}, filesystem) {
+		err = fmt.Errorf("expected NTFS or exFAT alongside UEFI:NTFS, found %s", getFilesystemName(filesystem))
+	}
+	results = append(results, newCheckResult("Sources partition filesystem", err, getFilesystemName(filesystem)))
+	for _, result := range results {
+		if !result.Passed {
+			return results, nil, ""
+		}
+	}
+	layout := NewManifestLayout(useGpt, singlePartition, dataPartition, filesystem)
+	return results, &layout, primaryPartition
+}
+
+// mountSourcesPartition flushes the cache of the sources partition and mounts it read-only, so
+// that its contents are read back from the drive. The returned function unmounts it again.
+func mountSourcesPartition(primaryPartition string) (mountPoint string, cacheFlushed bool, unmount func(), err error) {
+	cacheFlushed = true
+	if err := FlushBlockDeviceCache(primaryPartition); err != nil {
+		log.Printf("Failed to flush cache for %s, validation may read from memory: %v", primaryPartition, err)
+		cacheFlushed = false
+	}
+	mountPoint, err = os.MkdirTemp(os.TempDir(), "glassusb-")
+	if err != nil {
+		return "", false, nil, fmt.Errorf("failed to create mount point: %w", err)
+	}
+	if err := MountPartitionReadOnly(primaryPartition, mountPoint); err != nil {
+		os.Remove(mountPoint)
+		return "", false, nil, err
+	}
+	return mountPoint, cacheFlushed, func() {
+		if err := UnmountPartition(mountPoint); err != nil {
+			log.Printf("Failed to unmount partition: %v", err)
+		}
+		os.Remove(mountPoint)
+	}, nil
+}
+
+// VerifyDriveAgainstISO checks the partition layout, the UEFI:NTFS partition and the contents of
+// the sources partition on a drive against the given ISO, without writing to the drive.
+func VerifyDriveAgainstISO(ctx context.Context, renderer *ProgressRenderer, iso *udf.Udf, blockDevice string, exclude ExcludePatterns, overlay Overlay) []CheckResult {
+	results, layout, primaryPartition := checkDrivePartitions(blockDevice)
+	if layout == nil {
+		return results
+	}
+
+	renderer.SetPhase("Validating ISO contents on sources partition")
+	mountPoint, cacheFlushed, unmount, err := mountSourcesPartition(primaryPartition)
+	if err != nil {
+		return append(results, newCheckResult("ISO contents", err, ""))
+	}
+	defer unmount()
+	guarantee, err := ValidateISOAgainstLocation(ctx, renderer.Update, iso, mountPoint, exclude, ValidationFull, nil, overlay)
+	if !cacheFlushed {
+		guarantee = ReadGuaranteeNone
+	}
+	return append(results, newCheckResult("ISO contents", err, guarantee.String()))
+}
+
+// VerifyDriveAgainstManifest checks a drive like VerifyDriveAgainstISO, but using only the
+// manifest written to the drive when it was flashed.
+func VerifyDriveAgainstManifest(ctx context.Context, renderer *ProgressRenderer, blockDevice string) []CheckResult {
+	results, layout, primaryPartition := checkDrivePartitions(blockDevice)
+	if layout == nil {
+		return results
+	}
+
+	mountPoint, cacheFlushed, unmount, err := mountSourcesPartition(primaryPartition)
+	if err != nil {
+		return append(results, newCheckResult("Manifest", err, ""))
+	}
+	defer unmount()
+	manifest, err := ReadManifest(mountPoint)
+	if err != nil {
+		return append(results, newCheckResult("Manifest", err, ""))
+	}
+	details := fmt.Sprintf("Written by glassUSB %s on %s from %s",
+		manifest.GlassUSBVersion, manifest.CreatedAt.Local().Format(time.DateTime), manifest.ISO.Name)
+	if manifest.ISO.SHA256 != "" {
+		details += "\nISO SHA-256: " + manifest.ISO.SHA256
+	}
+	results = append(results, newCheckResult("Manifest", nil, details))
+	if manifest.Layout != *layout {
+		err = fmt.Errorf("manifest records %s (%s), but the drive has %s (%s)",
+			describeDiskLayout(manifest.Layout.PartitionTable == "gpt", manifest.Layout.SinglePartition,
+				manifest.Layout.DataPartition),
+			getFilesystemName(manifest.Layout.Filesystem),
+			describeDiskLayout(layout.PartitionTable == "gpt", layout.SinglePartition, layout.DataPartition),
+			getFilesystemName(layout.Filesystem))
+	}
+	results = append(results, newCheckResult("Layout matches manifest", err, ""))
+
+	renderer.SetPhase("Validating files on sources partition against manifest")
+	guarantee, err := ValidateManifestAgainstLocation(ctx, renderer.Update, manifest, mountPoint)
+	if !cacheFlushed {
+		guarantee = ReadGuaranteeNone
+	}
+	return append(results, newCheckResult("Manifest contents", err, guarantee.String()))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/retrixe/udf"
+)
+
+// wimHeaderSize is the size of the header at the start of WIM and ESD files.
+const wimHeaderSize = 208
+
+// wimMaxXMLSize bounds the XML metadata read from a WIM, which is typically well under 1 MiB.
+const wimMaxXMLSize = 16 * 1024 * 1024
+
+// wimArchNames maps the PROCESSOR_ARCHITECTURE values used in WIM metadata to names.
+var wimArchNames = map[int]string{0: "x86", 5: "arm", 9: "x64", 12: "arm64"}
+
+// WindowsBuild describes the Windows images in an ISO's install.wim or install.esd.
+type WindowsBuild struct {
+	Version  string   `json:"version"` // e.g. 10.0.22631.2861
+	Arch     string   `json:"arch"`
+	Editions []string `json:"editions"`
+}
+
+type wimXML struct {
+	Images []struct {
+		Name    string `xml:"NAME"`
+		Windows struct {
+			Arch    int `xml:"ARCH"`
+			Version struct {
+				Major   int `xml:"MAJOR"`
+				Minor   int `xml:"MINOR"`
+				Build   int `xml:"BUILD"`
+				SPBuild int `xml:"SPBUILD"`
+			} `xml:"VERSION"`
+		} `xml:"WINDOWS"`
+	} `xml:"IMAGE"`
+}
+
+// DetectWindowsBuild reads the Windows version, architecture and editions from the metadata of the
+// install image in an ISO's sources folder.
+func DetectWindowsBuild(iso *udf.Udf) (*WindowsBuild, error) {
+	var image *udf.File
+	for _, file := range iso.ReadDir(nil) {
+		if !file.IsDir() || !strings.EqualFold(file.Name(), "sources") {
+			continue
+		}
+		for _, child := range file.ReadDir() {
+			name := strings.ToLower(child.Name())
+			if name == "install.wim" || name == "install.esd" || name == "install.swm" {
+				image = &child
+				break
+			}
+		}
+	}
+	if image == nil {
+		return nil, errors.New("no install.wim or install.esd found in the ISO")
+	}
+	return readWIMBuild(image.NewReader())
+}
+
+func readWIMBuild(wim io.ReaderAt) (*WindowsBuild, error) {
+	header := make([]byte, wimHeaderSize)
+	if _, err := wim.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read WIM header: %w", err)
+	} else if !bytes.Equal(header[:8], []byte("MSWIM\x00\x00\x00")) {
+		return nil, errors.New("install image is not a WIM file")
+	}
+	// The XML data resource header is at offset 72: a 7-byte size and flags, then the offset
+	xmlSize := int64(binary.LittleEndian.Uint64(header[72:80]) & 0x00ffffffffffffff)
+	xmlOffset := int64(binary.LittleEndian.Uint64(header[80:88]))
+	if xmlSize <= 2 || xmlSize > wimMaxXMLSize || xmlSize%2 != 0 {
+		return nil, fmt.Errorf("WIM has invalid XML metadata size %d", xmlSize)
+	}
+	data := make([]byte, xmlSize)
+	if _, err := wim.ReadAt(data, xmlOffset); err != nil {
+		return nil, fmt.Errorf("failed to read WIM metadata: %w", err)
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	text := strings.TrimPrefix(string(utf16.Decode(units)), "\ufeff")
+
+	var metadata wimXML
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil // Already decoded from UTF-16
+	}
+	if err := decoder.Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse WIM metadata: %w", err)
+	} else if len(metadata.Images) == 0 {
+		return nil, errors.New("WIM contains no images")
+	}
+	first := metadata.Images[0].Windows
+	build := &WindowsBuild{
+		Version: fmt.Sprintf("%d.%d.%d.%d", first.Version.Major, first.Version.Minor,
+			first.Version.Build, first.Version.SPBuild),
+		Arch: wimArchNames[first.Arch],
+	}
+	for _, image := range metadata.Images {
+		if !slices.Contains(build.Editions, image.Name) {
+			build.Editions = append(build.Editions, image.Name)
+		}
+	}
+	return build, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// writeBackWindow is the amount of data written to a file before writeback of it is started.
+const writeBackWindow = 16 * 1024 * 1024
+
+// writeBackController limits the amount of dirty data in the page cache while copying a file, so
+// that progress reflects what has actually been written to the USB drive, and copying a large file
+// doesn't freeze the rest of the system by filling memory with dirty pages.
+//
+// Writeback of each window is started as soon as it is written, after which the previous window is
+// waited upon and dropped from the page cache, so at most two windows are dirty at any given time.
+// Pages read from the source are dropped alongside, since they will not be read again.
+//
+// If the OS or filesystem doesn't support starting writeback of a file range, the controller falls
+// back to calling fsync once every window.
+type writeBackController struct {
+	src       *os.File // May be nil, if the source is not backed by a file
+	srcOffset int64
+	dst       *os.File
+	written   int64
+	started   int64 // End of the window for which writeback was last started
+	waited    int64 // End of the window which was last waited upon
+	fallback  bool
+}
+
+func newWriteBackController(src *io.SectionReader, dst *os.File) *writeBackController {
+	w := &writeBackController{dst: dst}
+	if outer, offset, size := src.Outer(); outer != nil {
+		if file, ok := outer.(*os.File); ok {
+			w.src = file
+			w.srcOffset = offset
+			adviseSequential(file, offset, size)
+		}
+	}
+	return w
+}
+
+// Add records that n more bytes were written to the destination, and starts writeback of the
+// written data once a full window is pending.
+func (w *writeBackController) Add(n int) error {
+	w.written += int64(n)
+	if w.written-w.started < writeBackWindow {
+		return nil
+	}
+	if !w.fallback {
+		err := startWriteBack(w.dst, w.started, w.written-w.started)
+		if errors.Is(err, errors.ErrUnsupported) {
+			w.fallback = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if w.fallback {
+		if err := w.dst.Sync(); err != nil {
+			return err
+		}
+		w.started = w.written
+		w.waited = w.written
+		return nil
+	}
+	// Wait for the previous window to hit the disk, then drop it from the page cache
+	if w.started > w.waited {
+		if err := waitWriteBack(w.dst, w.waited, w.started-w.waited); err != nil {
+			return err
+		}
+		dropCache(w.dst, w.waited, w.started-w.waited)
+		if w.src != nil {
+			dropCache(w.src, w.srcOffset+w.waited, w.started-w.waited)
+		}
+	}
+	w.waited = w.started
+	w.started = w.written
+	return nil
+}
+
+// Rewind forgets about data which hasn't been confirmed to be on disk yet, after writing it back
+// failed, and returns the offset from which it should be rewritten.
+func (w *writeBackController) Rewind() int64 {
+	w.written = w.waited
+	w.started = w.waited
+	return w.waited
+}
+
+// Finish flushes all remaining data and metadata to disk, and drops the file from the page cache.
+func (w *writeBackController) Finish() error {
+	if err := w.dst.Sync(); err != nil {
+		return err
+	}
+	dropCache(w.dst, 0, 0)
+	if w.src != nil {
+		dropCache(w.src, w.srcOffset, w.written)
+	}
+	return nil
+}
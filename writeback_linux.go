@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func startWriteBack(file *os.File, offset int64, length int64) error {
+	err := unix.SyncFileRange(int(file.Fd()), offset, length, unix.SYNC_FILE_RANGE_WRITE)
+	if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
+
+func waitWriteBack(file *os.File, offset int64, length int64) error {
+	return unix.SyncFileRange(int(file.Fd()), offset, length, unix.SYNC_FILE_RANGE_WRITE_AND_WAIT)
+}
+
+func dropCache(file *os.File, offset int64, length int64) {
+	_ = unix.Fadvise(int(file.Fd()), offset, length, unix.FADV_DONTNEED) // Purely advisory
+}
+
+func adviseSequential(file *os.File, offset int64, length int64) {
+	_ = unix.Fadvise(int(file.Fd()), offset, length, unix.FADV_SEQUENTIAL) // Purely advisory
+}
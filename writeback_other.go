@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func startWriteBack(file *os.File, offset int64, length int64) error {
+	return errors.ErrUnsupported
+}
+
+func waitWriteBack(file *os.File, offset int64, length int64) error {
+	return errors.ErrUnsupported
+}
+
+func dropCache(file *os.File, offset int64, length int64) {}
+
+func adviseSequential(file *os.File, offset int64, length int64) {}